@@ -0,0 +1,539 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Chunks of a 3DS file read by the parser, everything else is skipped
+const (
+	chunkMain         = 0x4D4D
+	chunkEditor       = 0x3D3D
+	chunkObject       = 0x4000
+	chunkTriMesh      = 0x4100
+	chunkPoints       = 0x4110
+	chunkFaces        = 0x4120
+	chunkFaceMaterial = 0x4130
+	chunkTexVerts     = 0x4140
+	chunkSmoothGroups = 0x4150
+	chunkMeshMatrix   = 0x4160
+	chunkMaterial     = 0xAFFF
+	chunkMatName      = 0xA000
+	chunkMatAmbient   = 0xA010
+	chunkMatDiffuse   = 0xA020
+	chunkMatSpecular  = 0xA030
+	chunkMatShininess = 0xA040
+	chunkMatStrength  = 0xA041
+	chunkMatTransp    = 0xA050
+	chunkMatTwoSide   = 0xA081
+	chunkMatTexture   = 0xA200
+	chunkMapFile      = 0xA300
+	chunkColorFloat   = 0x0010
+	chunkColor24      = 0x0011
+	chunkLinColor24   = 0x0012
+	chunkLinColorF    = 0x0013
+	chunkPercentInt   = 0x0030
+	chunkPercentFloat = 0x0031
+)
+
+// chunk3DS is a chunk of a 3DS file, its data excluding the six byte header
+type chunk3DS struct {
+	id     uint16
+	offset int
+	data   []byte
+}
+
+// object3DS is a triangle mesh object of a 3DS file
+type object3DS struct {
+	name      string
+	points    []Vec3
+	uvs       []Vec3
+	faces     [][3]int
+	smoothing []uint32
+	// materials names the material of each face, "" for faces without one
+	materials []string
+	matrix    Matrix
+}
+
+// Open3DS reads the triangle mesh objects of a 3DS file and their materials into one Mesh, with a
+// MeshGroup for each object and material. 3DS files are z up, so they are turned to be y up like OBJ
+// files. Faces sharing a smoothing group share vertex normals, the others are flat.
+func Open3DS(path string) (*Mesh, error) {
+	return open3DS(path, false)
+}
+
+// open3DS reads a 3DS file like Open3DS, keeping its texture maps inside its directory if confined
+func open3DS(path string, confined bool) (*Mesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return parse3DS(file, path, confined)
+}
+
+// Parse3DS reads a 3DS file from r, prefixing errors with path, which also locates texture maps
+func Parse3DS(r io.Reader, path string) (*Mesh, error) {
+	return parse3DS(r, path, false)
+}
+
+func parse3DS(r io.Reader, path string, confined bool) (*Mesh, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	top, err := children3DS(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(top) != 1 || top[0].id != chunkMain {
+		return nil, fmt.Errorf("%s: not a 3DS file", path)
+	}
+	main, err := children3DS(top[0].data, top[0].offset)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var objects []*object3DS
+	materials := make(map[string]*Material)
+	for _, c := range main {
+		if c.id != chunkEditor {
+			continue
+		}
+		editor, err := children3DS(c.data, c.offset)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for _, e := range editor {
+			switch e.id {
+			case chunkObject:
+				o, err := read3DSObject(e)
+				if err != nil {
+					return nil, fmt.Errorf("%s: chunk at %d: %v", path, e.offset, err)
+				}
+				if o != nil {
+					objects = append(objects, o)
+				}
+			case chunkMaterial:
+				m, err := read3DSMaterial(e, filepath.Dir(path), confined)
+				if err != nil {
+					return nil, fmt.Errorf("%s: chunk at %d: %v", path, e.offset, err)
+				}
+				materials[m.Name] = m
+			}
+		}
+	}
+	textures := make(map[textureKey]*ImageTexture)
+	for _, m := range materials {
+		m.loadMaps(textures)
+	}
+	mesh := newMesh()
+	for _, o := range objects {
+		first := len(mesh.faces)
+		o.addTo(mesh, materials)
+		for i := first; i < len(mesh.faces); i++ {
+			material := mesh.materials[mesh.faces[i].Material]
+			n := len(mesh.groups)
+			if i == first || mesh.groups[n-1].Material != material {
+				mesh.groups = append(mesh.groups, MeshGroup{o.name, "", material, i, 0})
+				n++
+			}
+			mesh.groups[n-1].Count++
+		}
+	}
+	if len(mesh.faces) == 0 {
+		return nil, fmt.Errorf("%s: no triangles", path)
+	}
+	mesh.finish()
+	return mesh, nil
+}
+
+// children3DS splits data, found at offset in the file, into chunks
+func children3DS(data []byte, offset int) ([]chunk3DS, error) {
+	var chunks []chunk3DS
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 6 {
+			return nil, fmt.Errorf("chunk at %d is truncated", offset+pos)
+		}
+		id := binary.LittleEndian.Uint16(data[pos:])
+		length := int64(binary.LittleEndian.Uint32(data[pos+2:]))
+		if length < 6 || length > int64(len(data)-pos) {
+			return nil, fmt.Errorf("chunk 0x%04X at %d has a bad length %d", id, offset+pos, length)
+		}
+		chunks = append(chunks, chunk3DS{id, offset + pos + 6, data[pos+6 : pos+int(length)]})
+		pos += int(length)
+	}
+	return chunks, nil
+}
+
+// cString splits a null terminated string off the start of data
+func cString(data []byte) (string, []byte, error) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), data[i+1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("string isn't terminated")
+}
+
+// read3DSObject reads a named object, returning nil for objects that aren't triangle meshes
+func read3DSObject(c chunk3DS) (*object3DS, error) {
+	name, rest, err := cString(c.data)
+	if err != nil {
+		return nil, err
+	}
+	children, err := children3DS(rest, c.offset+len(c.data)-len(rest))
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		if child.id == chunkTriMesh {
+			o, err := read3DSTriMesh(child)
+			if err != nil {
+				return nil, fmt.Errorf("object %q: %v", name, err)
+			}
+			o.name = name
+			return o, nil
+		}
+	}
+	// Lights and cameras aren't read
+	return nil, nil
+}
+
+func read3DSTriMesh(c chunk3DS) (*object3DS, error) {
+	o := &object3DS{matrix: Identity()}
+	children, err := children3DS(c.data, c.offset)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		d := child.data
+		switch child.id {
+		case chunkPoints:
+			floats, err := read3DSFloats(d, 3)
+			if err != nil {
+				return nil, fmt.Errorf("vertices: %v", err)
+			}
+			for i := 0; i < len(floats); i += 3 {
+				o.points = append(o.points, Vec3{floats[i], floats[i+1], floats[i+2]})
+			}
+		case chunkTexVerts:
+			floats, err := read3DSFloats(d, 2)
+			if err != nil {
+				return nil, fmt.Errorf("texture coordinates: %v", err)
+			}
+			for i := 0; i < len(floats); i += 2 {
+				o.uvs = append(o.uvs, Vec3{floats[i], floats[i+1], 0})
+			}
+		case chunkMeshMatrix:
+			if len(d) < 48 {
+				return nil, fmt.Errorf("mesh matrix is truncated")
+			}
+			var m [12]float64
+			for i := range m {
+				m[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(d[4*i:])))
+			}
+			// The rows of the file are the x, y and z axes and the origin of the object
+			o.matrix = Matrix{
+				m[0], m[3], m[6], m[9],
+				m[1], m[4], m[7], m[10],
+				m[2], m[5], m[8], m[11],
+				0, 0, 0, 1}
+		case chunkFaces:
+			if err := o.readFaces(child); err != nil {
+				return nil, fmt.Errorf("faces: %v", err)
+			}
+		}
+	}
+	for _, f := range o.faces {
+		for _, i := range f {
+			if i >= len(o.points) {
+				return nil, fmt.Errorf("vertex %d is out of range, there are %d", i, len(o.points))
+			}
+		}
+	}
+	if len(o.uvs) != 0 && len(o.uvs) != len(o.points) {
+		return nil, fmt.Errorf("%d texture coordinates for %d vertices", len(o.uvs), len(o.points))
+	}
+	return o, nil
+}
+
+// read3DSFloats reads a count of vectors with n float32 components each
+func read3DSFloats(d []byte, n int) ([]float64, error) {
+	if len(d) < 2 {
+		return nil, fmt.Errorf("count is truncated")
+	}
+	count := int(binary.LittleEndian.Uint16(d))
+	if len(d) < 2+4*n*count {
+		return nil, fmt.Errorf("%d entries don't fit in the chunk", count)
+	}
+	floats := make([]float64, n*count)
+	for i := range floats {
+		floats[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(d[2+4*i:])))
+		if math.IsNaN(floats[i]) || math.IsInf(floats[i], 0) {
+			return nil, fmt.Errorf("entry %d isn't finite", i/n)
+		}
+	}
+	return floats, nil
+}
+
+// readFaces reads the face list and the material and smoothing group chunks that follow it
+func (o *object3DS) readFaces(c chunk3DS) error {
+	d := c.data
+	if len(d) < 2 {
+		return fmt.Errorf("count is truncated")
+	}
+	count := int(binary.LittleEndian.Uint16(d))
+	if len(d) < 2+8*count {
+		return fmt.Errorf("%d faces don't fit in the chunk", count)
+	}
+	o.faces = make([][3]int, count)
+	o.materials = make([]string, count)
+	for i := range o.faces {
+		for j := 0; j < 3; j++ {
+			o.faces[i][j] = int(binary.LittleEndian.Uint16(d[2+8*i+2*j:]))
+		}
+		// The fourth value holds edge visibility flags, which don't matter here
+	}
+	children, err := children3DS(d[2+8*count:], c.offset+2+8*count)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		switch child.id {
+		case chunkFaceMaterial:
+			name, rest, err := cString(child.data)
+			if err != nil {
+				return err
+			}
+			if len(rest) < 2 || len(rest) < 2+2*int(binary.LittleEndian.Uint16(rest)) {
+				return fmt.Errorf("material %q face list is truncated", name)
+			}
+			for i := 0; i < int(binary.LittleEndian.Uint16(rest)); i++ {
+				face := int(binary.LittleEndian.Uint16(rest[2+2*i:]))
+				if face >= count {
+					return fmt.Errorf("material %q face %d is out of range, there are %d", name, face, count)
+				}
+				o.materials[face] = name
+			}
+		case chunkSmoothGroups:
+			if len(child.data) < 4*count {
+				return fmt.Errorf("smoothing groups are truncated")
+			}
+			o.smoothing = make([]uint32, count)
+			for i := range o.smoothing {
+				o.smoothing[i] = binary.LittleEndian.Uint32(child.data[4*i:])
+			}
+		}
+	}
+	return nil
+}
+
+// addTo adds the faces of the object to m, turned y up. Degenerate faces are dropped.
+func (o *object3DS) addTo(m *Mesh, materials map[string]*Material) {
+	// z up to y up is a rotation about x, so the winding is kept. Objects whose matrix mirrors them
+	// were stored with their faces turned inside out.
+	first := uint32(len(m.positions))
+	for _, p := range o.points {
+		m.positions = append(m.positions, Vec3{p.X, p.Z, -p.Y})
+	}
+	points := m.positions[first:]
+	firstUV := uint32(len(m.uvs))
+	m.uvs = append(m.uvs, o.uvs...)
+	mirrored := o.matrix.Determinant() < 0
+	faceNormals := make([]Vec3, len(o.faces))
+	for i, f := range o.faces {
+		if mirrored {
+			o.faces[i][1], o.faces[i][2] = f[2], f[1]
+			f = o.faces[i]
+		}
+		// Left unnormalized, so larger faces weigh more in smoothed normals
+		faceNormals[i] = crossProduct(points[f[1]].Sub(points[f[0]]), points[f[2]].Sub(points[f[0]]))
+	}
+	// Faces around each vertex, for smoothing
+	var around [][]int
+	if o.smoothing != nil {
+		around = make([][]int, len(points))
+		for i, f := range o.faces {
+			for _, v := range f {
+				around[v] = append(around[v], i)
+			}
+		}
+	}
+	for i, f := range o.faces {
+		if faceNormals[i] == zeroVec {
+			continue
+		}
+		var face meshFace
+		for j, v := range f {
+			face.V[j] = first + uint32(v)
+			if len(o.uvs) > 0 {
+				face.T[j] = firstUV + uint32(v)
+			}
+		}
+		// Each corner of a smoothed face gets its own normal, since a vertex may be in several groups
+		if o.smoothing != nil && o.smoothing[i] != 0 {
+			for j, v := range f {
+				var normal Vec3
+				for _, g := range around[v] {
+					if o.smoothing[g]&o.smoothing[i] != 0 {
+						normal = normal.Add(faceNormals[g])
+					}
+				}
+				m.normals = append(m.normals, normal.Normalize())
+				face.N[j] = uint32(len(m.normals) - 1)
+			}
+		}
+		if name := o.materials[i]; name != "" {
+			face.Material = m.addMaterial(materials[name])
+		}
+		m.faces = append(m.faces, face)
+	}
+}
+
+// read3DSMaterial reads the name, colors, shininess, transparency, sidedness and texture map of a material
+func read3DSMaterial(c chunk3DS, dir string, confined bool) (*Material, error) {
+	children, err := children3DS(c.data, c.offset)
+	if err != nil {
+		return nil, err
+	}
+	m := newMaterial("")
+	strength := 1.0
+	for _, child := range children {
+		switch child.id {
+		case chunkMatName:
+			if m.Name, _, err = cString(child.data); err != nil {
+				return nil, err
+			}
+		case chunkMatAmbient, chunkMatDiffuse, chunkMatSpecular:
+			color, err := read3DSColor(child)
+			if err != nil {
+				return nil, err
+			}
+			switch child.id {
+			case chunkMatAmbient:
+				m.Ambient = color
+			case chunkMatDiffuse:
+				m.Diffuse = color
+			default:
+				m.Specular = color
+			}
+		case chunkMatShininess, chunkMatStrength, chunkMatTransp:
+			p, err := read3DSPercent(child)
+			if err != nil {
+				return nil, err
+			}
+			switch child.id {
+			case chunkMatShininess:
+				// Shininess runs from 0 to 1, mapped onto the usual range of Ns
+				m.Shininess = math.Max(1, p*128)
+			case chunkMatStrength:
+				strength = p
+			default:
+				m.Opacity = 1 - p
+			}
+		case chunkMatTwoSide:
+			m.DoubleSided = true
+		case chunkMatTexture:
+			maps, err := children3DS(child.data, child.offset)
+			if err != nil {
+				return nil, err
+			}
+			for _, mc := range maps {
+				if mc.id != chunkMapFile {
+					continue
+				}
+				name, _, err := cString(mc.data)
+				if err != nil {
+					return nil, err
+				}
+				// 3DS files come from DOS and Windows, with backslashes and often the wrong case
+				path, err := localFile(dir, strings.ReplaceAll(name, `\`, "/"), confined)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "material %s: %v\n", m.Name, err)
+					continue
+				}
+				m.Maps["map_kd"] = TextureMap{Path: path, Options: make(map[string][]string), Scale: Vec3{1, 1, 1}, Bump: 1}
+			}
+		}
+	}
+	m.Specular = m.Specular.Mul(strength)
+	return m, nil
+}
+
+// read3DSColor reads the color in the subchunks of a material color chunk, preferring linear colors
+func read3DSColor(c chunk3DS) (Vec3, error) {
+	children, err := children3DS(c.data, c.offset)
+	if err != nil {
+		return zeroVec, err
+	}
+	var color Vec3
+	found := false
+	for _, child := range children {
+		d := child.data
+		switch child.id {
+		case chunkColorFloat, chunkLinColorF:
+			if len(d) < 12 {
+				return zeroVec, fmt.Errorf("color is truncated")
+			}
+			if found && child.id == chunkColorFloat {
+				continue
+			}
+			color = Vec3{float64(math.Float32frombits(binary.LittleEndian.Uint32(d))),
+				float64(math.Float32frombits(binary.LittleEndian.Uint32(d[4:]))),
+				float64(math.Float32frombits(binary.LittleEndian.Uint32(d[8:])))}
+			found = true
+		case chunkColor24, chunkLinColor24:
+			if len(d) < 3 {
+				return zeroVec, fmt.Errorf("color is truncated")
+			}
+			if found && child.id == chunkColor24 {
+				continue
+			}
+			color = Vec3{float64(d[0]) / 255, float64(d[1]) / 255, float64(d[2]) / 255}
+			found = true
+		}
+	}
+	return color, nil
+}
+
+// read3DSPercent reads the percentage in the subchunks of a chunk as a fraction
+func read3DSPercent(c chunk3DS) (float64, error) {
+	children, err := children3DS(c.data, c.offset)
+	if err != nil {
+		return 0, err
+	}
+	for _, child := range children {
+		switch {
+		case child.id == chunkPercentInt && len(child.data) >= 2:
+			return float64(int16(binary.LittleEndian.Uint16(child.data))) / 100, nil
+		case child.id == chunkPercentFloat && len(child.data) >= 4:
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(child.data))) / 100, nil
+		}
+	}
+	return 0, fmt.Errorf("percentage is missing")
+}
@@ -0,0 +1,82 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"image"
+	"math"
+)
+
+// minAdaptiveSamples is how many samples a pixel needs before we trust its variance estimate
+const minAdaptiveSamples = 4
+
+// Converged reports whether pixel (x, y) has enough samples and a relative error at or below threshold
+func (fb *Framebuffer) Converged(x, y int, threshold float64) bool {
+	return fb.SampleCount(x, y) >= minAdaptiveSamples && fb.RelativeError(x, y) <= threshold
+}
+
+// heatmapColors is the ramp used by SampleHeatmap, from fewest to most samples
+var heatmapColors = []Vec3{
+	{0, 0, 0},
+	{0, 0, 1},
+	{1, 0, 0},
+	{1, 1, 0},
+	{1, 1, 1},
+}
+
+// SampleHeatmap visualises the sample count of every pixel on a logarithmic scale.
+// Black pixels have the fewest samples, white pixels the most.
+func (fb *Framebuffer) SampleHeatmap() *image.RGBA {
+	min, max := uint32(math.MaxUint32), uint32(0)
+	for _, n := range fb.Samples {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, fb.Width, fb.Height))
+	scale := math.Log2(float64(max) + 1 - float64(min))
+	for y := 0; y < fb.Height; y++ {
+		for x := 0; x < fb.Width; x++ {
+			t := 0.0
+			if scale > 0 {
+				t = math.Log2(float64(fb.SampleCount(x, y))+1-float64(min)) / scale
+			}
+			c := heatmapColor(t)
+			i := img.PixOffset(x, y)
+			img.Pix[i] = ratioToByte(c.X)
+			img.Pix[i+1] = ratioToByte(c.Y)
+			img.Pix[i+2] = ratioToByte(c.Z)
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+// heatmapColor interpolates heatmapColors at t in [0, 1]
+func heatmapColor(t float64) Vec3 {
+	f := clamp(t, 0, 1) * float64(len(heatmapColors)-1)
+	i := int(f)
+	if i >= len(heatmapColors)-1 {
+		return heatmapColors[len(heatmapColors)-1]
+	}
+	a, b := heatmapColors[i], heatmapColors[i+1]
+	return a.Mul(1 - (f - float64(i))).Add(b.Mul(f - float64(i)))
+}
@@ -0,0 +1,98 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"image"
+	"image/color"
+)
+
+// AOVNames lists the arbitrary output variables AOVBuffers can turn into images
+var AOVNames = []string{"albedo", "normal", "depth"}
+
+// AOVBuffers hold the arbitrary output variables of a render: the albedo, normal and depth of the
+// primary hit through the centre of every pixel
+type AOVBuffers struct {
+	width  int
+	albedo []Vec3
+	normal []Vec3
+	depth  []float64
+}
+
+func newAOVBuffers(w, h int) *AOVBuffers {
+	return &AOVBuffers{w, make([]Vec3, w*h), make([]Vec3, w*h), make([]float64, w*h)}
+}
+
+func (aov *AOVBuffers) record(x, y int, scene *Scene, ray RayDifferential) {
+	i := y*aov.width + x
+	hit, object := scene.intersect(ray.Ray)
+	if object == nil {
+		aov.albedo[i] = backgroundColor
+		aov.depth[i] = infinity
+		return
+	}
+	ray.footprint(&hit, object)
+	aov.albedo[i] = surfaceColor(hit, object)
+	aov.normal[i] = hit.Normal
+	if hit.Material != nil {
+		aov.normal[i] = hit.Material.shadingNormal(hit)
+	}
+	aov.depth[i] = hit.T
+}
+
+// Image returns the named AOV as an image, or nil if there is no such AOV.
+// Albedo is stored as sRGB, normals are mapped from [-1, 1] to [0, 1], and depth is a 16-bit
+// grayscale image where black is the nearest hit and white the farthest or no hit.
+func (aov *AOVBuffers) Image(name string) image.Image {
+	h := len(aov.depth) / aov.width
+	switch name {
+	case "albedo", "normal":
+		img := image.NewRGBA(image.Rect(0, 0, aov.width, h))
+		for i := range aov.depth {
+			var c Vec3
+			if name == "albedo" {
+				c = aov.albedo[i]
+				c.linearToSRGB()
+			} else {
+				c = aov.normal[i].Mul(0.5).Add(Vec3{0.5, 0.5, 0.5})
+			}
+			img.Pix[4*i] = ratioToByte(c.X)
+			img.Pix[4*i+1] = ratioToByte(c.Y)
+			img.Pix[4*i+2] = ratioToByte(c.Z)
+			img.Pix[4*i+3] = 255
+		}
+		return img
+	case "depth":
+		max := 0.0
+		for _, d := range aov.depth {
+			if d < infinity && d > max {
+				max = d
+			}
+		}
+		img := image.NewGray16(image.Rect(0, 0, aov.width, h))
+		for i, d := range aov.depth {
+			v := 1.0
+			if d < infinity && max > 0 {
+				v = d / max
+			}
+			img.SetGray16(i%aov.width, i/aov.width, color.Gray16{ratioToColor(v)})
+		}
+		return img
+	}
+	return nil
+}
@@ -46,8 +46,19 @@ func (c *Camera) Init(eye Vec3, w, h int) {
 	c.aspectRatio = c.width / c.height
 }
 
+// SetFOV changes the field of view of the camera to fov degrees
+func (c *Camera) SetFOV(fov float64) {
+	c.fov = fov
+	c.scale = math.Tan(degToRad(c.fov * 0.5))
+}
+
 func (c *Camera) rayForPixel(x int, y int) Ray {
-	dir := Vec3{(2*(float64(x)+0.5)/c.width - 1) * c.aspectRatio * c.scale, (1 - 2*(float64(y)+0.5)/c.height) * c.scale,
+	return c.rayForSample(x, y, 0.5, 0.5)
+}
+
+// rayForSample returns a ray through the point (dx, dy) inside pixel (x, y), both offsets in [0, 1)
+func (c *Camera) rayForSample(x, y int, dx, dy float64) Ray {
+	dir := Vec3{(2*(float64(x)+dx)/c.width - 1) * c.aspectRatio * c.scale, (1 - 2*(float64(y)+dy)/c.height) * c.scale,
 		float64(c.depth)}.Normalize()
 	return Ray{c.eye, dir}
 }
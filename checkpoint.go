@@ -0,0 +1,267 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// checkpointVersion is bumped whenever the layout of Checkpoint changes
+const checkpointVersion = 2
+
+// Checkpoint is the state of an unfinished render as it is stored on disk
+type Checkpoint struct {
+	Version int
+	// Hash identifies the scene and settings the checkpoint was rendered with
+	Hash        []byte
+	Pass        int
+	PassSamples int
+	SPP         int
+	Sampled     int64
+	TileDone    []bool
+	Width       int
+	Height      int
+	Pix         []float32
+	Lum         []float64
+	Lum2        []float64
+	Samples     []uint32
+}
+
+// SaveCheckpoint waits for the tiles being rendered to finish, then writes the framebuffer and the
+// tiles completed so far to path. The file is replaced atomically so a crash never leaves half a checkpoint.
+func (renderer *Renderer) SaveCheckpoint(path string, hash []byte) error {
+	renderer.lockWholeTiles()
+	defer renderer.lock.Unlock()
+	fb := renderer.fb
+	checkpoint := Checkpoint{checkpointVersion, hash, renderer.pass, renderer.passSamples, renderer.spp,
+		renderer.sampled, renderer.tileDone, fb.Width, fb.Height, fb.Pix, fb.Lum, fb.Lum2, fb.Samples}
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	bufWriter := bufio.NewWriter(file)
+	err = gob.NewEncoder(bufWriter).Encode(&checkpoint)
+	if err == nil {
+		err = bufWriter.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// checkpointPeriodically saves a checkpoint every interval until the returned stop function is called.
+// An interrupted render also saves a checkpoint before exiting.
+func checkpointPeriodically(renderer *Renderer, path string, hash []byte, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := renderer.SaveCheckpoint(path, hash); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+			case <-interrupt:
+				fmt.Printf("\nInterrupted, saving checkpoint to: %s\n", path)
+				if err := renderer.SaveCheckpoint(path, hash); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+				}
+				os.Exit(1)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		signal.Stop(interrupt)
+		close(done)
+	}
+}
+
+// LoadCheckpoint restores the framebuffer and progress saved at path, after checking it was
+// rendered with the same scene and settings
+func (renderer *Renderer) LoadCheckpoint(path string, hash []byte) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	var checkpoint Checkpoint
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&checkpoint); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if checkpoint.Version != checkpointVersion {
+		return fmt.Errorf("%s: checkpoint version %d, expected %d", path, checkpoint.Version, checkpointVersion)
+	}
+	if !bytes.Equal(checkpoint.Hash, hash) {
+		return fmt.Errorf("%s: checkpoint was rendered with a different scene or settings", path)
+	}
+	fb := renderer.fb
+	n := fb.Width * fb.Height
+	if checkpoint.Width != fb.Width || checkpoint.Height != fb.Height ||
+		len(checkpoint.Pix) != 3*n || len(checkpoint.Lum) != n || len(checkpoint.Lum2) != n ||
+		len(checkpoint.Samples) != n {
+		return fmt.Errorf("%s: checkpoint framebuffer doesn't match the image size", path)
+	}
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+	fb.Pix, fb.Lum, fb.Lum2, fb.Samples = checkpoint.Pix, checkpoint.Lum, checkpoint.Lum2, checkpoint.Samples
+	renderer.pass = checkpoint.Pass
+	renderer.passSamples = checkpoint.PassSamples
+	renderer.spp = checkpoint.SPP
+	renderer.sampled = checkpoint.Sampled
+	renderer.tileDone = checkpoint.TileDone
+	return nil
+}
+
+// renderSettings holds the options that change the rendered image
+type renderSettings struct {
+	Width, Height int
+	Tiles         []rect
+	// Regions limits the render to part of the image, empty for all of it
+	Regions     []rect
+	Samples     int
+	Progressive bool
+	// Limits has no TimeBudget, a resumed render may be given more or less time
+	Limits ProgressiveSettings
+}
+
+// renderHash returns a hash of everything that affects the rendered image:
+// the settings, the camera and the scene
+func renderHash(settings renderSettings, cam *Camera, scene *Scene) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%#v\n%#v\n%#v\n", settings, *cam, scene.light)
+	hashed := make(map[Geometry]int)
+	for _, object := range scene.geometry {
+		writeGeometryHash(h, object, hashed)
+	}
+	return h.Sum(nil)
+}
+
+// writeGeometryHash writes object to h. Geometry shared by instances is written the first time and
+// referred to by its number in hashed after that.
+func writeGeometryHash(h hash.Hash, object Geometry, hashed map[Geometry]int) {
+	switch g := object.(type) {
+	case *Instance:
+		fmt.Fprintf(h, "instance %#v\n", g.toWorld)
+		if i, ok := hashed[g.Geometry]; ok {
+			fmt.Fprintf(h, "shared %d\n", i)
+			return
+		}
+		hashed[g.Geometry] = len(hashed)
+		writeGeometryHash(h, g.Geometry, hashed)
+	case *Mesh:
+		// Printing every triangle is far slower than writing their raw bytes
+		fmt.Fprintf(h, "mesh %d %v\n", len(g.faces), g.Color())
+		// Faces are written as they were before meshes shared their vertices, so checkpoints stay valid
+		for i, f := range g.faces {
+			t := g.triangle(i)
+			writeVectors(h, t.V1, t.V2, t.V3, t.N1, t.N2, t.N3, t.T1, t.T2, t.T3, t.color)
+			if g.colors != nil {
+				writeVectors(h, g.colors[f.V[0]], g.colors[f.V[1]], g.colors[f.V[2]])
+			}
+		}
+		for _, group := range g.groups {
+			fmt.Fprintf(h, "group %q %q %d %d\n", group.Object, group.Group, group.First, group.Count)
+			if group.Material != nil {
+				writeMaterialHash(h, group.Material)
+			}
+		}
+		writeTextureHash(h, g.texture)
+		fmt.Fprintf(h, "culling %d\n", g.culling)
+	case *Sphere:
+		plain := *g
+		plain.texture = nil
+		fmt.Fprintf(h, "%#v\n", plain)
+		writeTextureHash(h, g.texture)
+	case *Plane:
+		plain := *g
+		plain.texture = nil
+		fmt.Fprintf(h, "%#v\n", plain)
+		writeTextureHash(h, g.texture)
+	default:
+		fmt.Fprintf(h, "%#v\n", object)
+	}
+}
+
+// writeMaterialHash writes a material and its texture maps
+func writeMaterialHash(h hash.Hash, m *Material) {
+	plain := *m
+	plain.Maps = nil
+	fmt.Fprintf(h, "%#v\n", plain)
+	var keywords []string
+	for keyword := range m.Maps {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		fmt.Fprintln(h, keyword)
+		writeTextureHash(h, m.Maps[keyword])
+	}
+}
+
+// writeTextureHash writes a texture, with the pixels of images rather than their addresses
+func writeTextureHash(h hash.Hash, t Texture) {
+	tm, ok := t.(TextureMap)
+	if !ok {
+		fmt.Fprintf(h, "%#v\n", t)
+		return
+	}
+	img := tm.Image
+	tm.Image = nil
+	fmt.Fprintf(h, "%#v\n", tm)
+	if img != nil {
+		fmt.Fprintf(h, "%dx%d\n", img.Width, img.Height)
+		binary.Write(h, binary.LittleEndian, img.Pix)
+	}
+}
+
+func writeVectors(w io.Writer, vectors ...Vec3) {
+	var buf [24]byte
+	for _, v := range vectors {
+		binary.LittleEndian.PutUint64(buf[0:], math.Float64bits(v.X))
+		binary.LittleEndian.PutUint64(buf[8:], math.Float64bits(v.Y))
+		binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(v.Z))
+		w.Write(buf[:])
+	}
+}
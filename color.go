@@ -32,6 +32,10 @@ func ratioToColor(f float64) uint16 {
 	return uint16(scaled)
 }
 
+func ratioToByte(f float64) uint8 {
+	return uint8(ratioToColor(f) >> 8)
+}
+
 func colorToRatio(i uint8) float64 {
 	return float64(i) / 255.0
 }
@@ -83,3 +87,7 @@ func (v *Vec3) gammaToLinear() {
 	v.Y = gammaToLinear(v.Y)
 	v.Z = gammaToLinear(v.Z)
 }
+
+func (v Vec3) luminance() float64 {
+	return 0.2126*v.X + 0.7152*v.Y + 0.0722*v.Z
+}
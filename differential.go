@@ -0,0 +1,166 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"math"
+)
+
+// RayDifferential is a ray with the rays through the same point of the neighbouring pixels to the right
+// and below, which tell texture lookups how much of the surface a sample covers (Igehy, "Tracing Ray
+// Differentials", 1999). The offset rays follow the main ray through reflections and transparent surfaces.
+type RayDifferential struct {
+	Ray
+	// HasDifferentials is false for rays without offset rays, whose lookups aren't filtered
+	HasDifferentials      bool
+	RxOrigin, RxDirection Vec3
+	RyOrigin, RyDirection Vec3
+}
+
+// rayDifferentialForSample returns the ray through the point (dx, dy) inside pixel (x, y) with its differentials
+func (c *Camera) rayDifferentialForSample(x, y int, dx, dy float64) RayDifferential {
+	rx := c.rayForSample(x+1, y, dx, dy)
+	ry := c.rayForSample(x, y+1, dx, dy)
+	return RayDifferential{c.rayForSample(x, y, dx, dy), true, rx.Origin, rx.Direction, ry.Origin, ry.Direction}
+}
+
+// offsetHits returns where the offset rays meet the plane through the hit point with normal n
+func (rd *RayDifferential) offsetHits(p, n Vec3) (px, py Vec3, ok bool) {
+	dx, dy := dotProduct(n, rd.RxDirection), dotProduct(n, rd.RyDirection)
+	if dx == 0 || dy == 0 {
+		return zeroVec, zeroVec, false
+	}
+	tx := dotProduct(n, p.Sub(rd.RxOrigin)) / dx
+	ty := dotProduct(n, p.Sub(rd.RyOrigin)) / dy
+	return rd.RxOrigin.Add(rd.RxDirection.Mul(tx)), rd.RyOrigin.Add(rd.RyDirection.Mul(ty)), true
+}
+
+// footprint sets the texture coordinate derivatives of a hit on object from the differentials, if the
+// hit is on a triangle with an image texture
+func (rd *RayDifferential) footprint(hit *Hit, object Geometry) {
+	if !rd.HasDifferentials || hit.Mesh == nil || !imageTextured(*hit, object) {
+		return
+	}
+	t, _ := hit.triangle()
+	dpdu, dpdv, ok := t.partials()
+	if !ok {
+		return
+	}
+	n := crossProduct(dpdu, dpdv)
+	px, py, ok := rd.offsetHits(hit.Point, n)
+	if !ok {
+		return
+	}
+	// Solve dp = dpdu du + dpdv dv in the two axes the triangle is least foreshortened in
+	a0, a1 := 1, 2
+	if math.Abs(n.Y) > math.Abs(n.X) && math.Abs(n.Y) > math.Abs(n.Z) {
+		a0, a1 = 0, 2
+	} else if math.Abs(n.Z) > math.Abs(n.X) {
+		a0, a1 = 0, 1
+	}
+	a := [2][2]float64{{axis(dpdu, a0), axis(dpdv, a0)}, {axis(dpdu, a1), axis(dpdv, a1)}}
+	det := a[0][0]*a[1][1] - a[0][1]*a[1][0]
+	if det == 0 {
+		return
+	}
+	solve := func(dp Vec3) Vec3 {
+		b0, b1 := axis(dp, a0), axis(dp, a1)
+		return Vec3{(a[1][1]*b0 - a[0][1]*b1) / det, (a[0][0]*b1 - a[1][0]*b0) / det, 0}
+	}
+	hit.DUVDX = solve(px.Sub(hit.Point))
+	hit.DUVDY = solve(py.Sub(hit.Point))
+}
+
+// readsImages reports whether shading any hit in the scene may read an image texture
+func (s *Scene) readsImages() bool {
+	for _, object := range s.geometry {
+		if geometryReadsImages(object) {
+			return true
+		}
+	}
+	return false
+}
+
+// geometryReadsImages reports whether shading a hit on object may read an image texture, which only
+// triangles filter
+func geometryReadsImages(object Geometry) bool {
+	switch g := object.(type) {
+	case *Mesh:
+		for _, m := range g.materials {
+			if m != nil && imageTextured(Hit{Material: m}, g) {
+				return true
+			}
+		}
+		return imageTextured(Hit{}, g)
+	case *Instance:
+		return geometryReadsImages(g.Geometry)
+	}
+	return false
+}
+
+// imageTextured reports whether the shading of a hit on object reads an image texture
+func imageTextured(hit Hit, object Geometry) bool {
+	if hit.Material != nil {
+		for _, tm := range hit.Material.Maps {
+			if tm.Image != nil {
+				return true
+			}
+		}
+		return false
+	}
+	switch g := object.(type) {
+	case *Mesh:
+		tm, ok := g.texture.(TextureMap)
+		return ok && tm.Image != nil
+	case *Instance:
+		return imageTextured(hit, g.Geometry)
+	}
+	return false
+}
+
+// reflect returns the reflection about n of the ray at a hit, with the offset rays reflected where
+// they meet the surface. The surface is treated as locally flat.
+func (rd *RayDifferential) reflect(hit Hit, n Vec3) RayDifferential {
+	reflected := RayDifferential{Ray: Ray{hit.Point.Add(hit.Normal.Mul(EPSILON)), rd.Direction.Reflect(n).Normalize()}}
+	if px, py, ok := rd.offsetHits(hit.Point, hit.Normal); rd.HasDifferentials && ok {
+		reflected.HasDifferentials = true
+		reflected.RxOrigin, reflected.RxDirection = px, rd.RxDirection.Reflect(n).Normalize()
+		reflected.RyOrigin, reflected.RyDirection = py, rd.RyDirection.Reflect(n).Normalize()
+	}
+	return reflected
+}
+
+// transmit returns the ray carrying on through a transparent surface at a hit
+func (rd *RayDifferential) transmit(hit Hit) RayDifferential {
+	through := *rd
+	through.Origin = hit.Point.Sub(hit.Normal.Mul(EPSILON))
+	if px, py, ok := rd.offsetHits(hit.Point, hit.Normal); rd.HasDifferentials && ok {
+		through.RxOrigin, through.RyOrigin = px, py
+	}
+	return through
+}
+
+// axis returns the X, Y or Z component of v for i 0, 1 or 2
+func axis(v Vec3, i int) float64 {
+	switch i {
+	case 0:
+		return v.X
+	case 1:
+		return v.Y
+	}
+	return v.Z
+}
@@ -0,0 +1,375 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// A distributed render has a coordinator that owns the framebuffer and hands out tiles, and any number
+// of worker processes that build the same scene, render the tiles and send the samples back. The
+// protocol is net/rpc over TCP. Each worker connection gets its own RPC server, so when a connection
+// drops the tiles leased to it go straight back into the queue. Tiles also have a lease timeout so
+// hung workers can't stall the render.
+
+// JoinArgs is sent by a worker when it connects
+type JoinArgs struct {
+	// Hash is the renderHash of the worker's scene and settings, it must match the coordinator's
+	Hash []byte
+}
+
+// TileAssignment tells a worker what to do next
+type TileAssignment struct {
+	// Done is set once every tile has been rendered
+	Done bool
+	// Wait is set when every remaining tile is leased to another worker
+	Wait    bool
+	Index   int
+	Pass    int
+	Samples int
+}
+
+// TileResult carries the samples of a rendered tile back to the coordinator
+type TileResult struct {
+	Index   int
+	Pix     []float32
+	Lum     []float64
+	Lum2    []float64
+	Samples []uint32
+}
+
+type tileLease struct {
+	worker  int
+	expires time.Time
+}
+
+// Coordinator hands out the tiles of a pass to remote workers and collects their results
+type Coordinator struct {
+	renderer *Renderer
+	tiles    []rect
+	hash     []byte
+	lease    time.Duration
+	bar      *pb.ProgressBar
+
+	mu         sync.Mutex
+	nextWorker int
+	pending    []int
+	leases     map[int]tileLease
+	remaining  int
+	finished   chan struct{}
+	// connected tracks the open worker connections
+	connected sync.WaitGroup
+}
+
+func newCoordinator(renderer *Renderer, tiles []rect, samples int, hash []byte, lease time.Duration) *Coordinator {
+	renderer.startPass(len(tiles), samples)
+	c := &Coordinator{renderer: renderer, tiles: tiles, hash: hash, lease: lease,
+		leases: make(map[int]tileLease), finished: make(chan struct{})}
+	// A pass restored from a checkpoint only needs its missing tiles
+	for i := range tiles {
+		if !renderer.tileDone[i] {
+			c.pending = append(c.pending, i)
+		}
+	}
+	c.remaining = len(c.pending)
+	c.bar = pb.StartNew(len(tiles))
+	c.bar.Set(len(tiles) - c.remaining)
+	if c.remaining == 0 {
+		close(c.finished)
+	}
+	return c
+}
+
+// Serve accepts workers on addr until every tile has been rendered
+func (c *Coordinator) Serve(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Waiting for workers on %s\n", ln.Addr())
+	return c.serve(ln)
+}
+
+// serve accepts workers on ln until every tile has been rendered, then closes it
+func (c *Coordinator) serve(ln net.Listener) error {
+	accepting := make(chan struct{})
+	go func() {
+		defer close(accepting)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.connected.Add(1)
+			go c.serveWorker(conn)
+		}
+	}()
+	<-c.finished
+	c.renderer.finishPass()
+	c.bar.FinishPrint("")
+	// Stop accepting first, so no connection is counted once we start waiting
+	err := ln.Close()
+	<-accepting
+	// Give the workers a moment to hear that we're done, so they can exit cleanly
+	disconnected := make(chan struct{})
+	go func() {
+		c.connected.Wait()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(3 * time.Second):
+	}
+	return err
+}
+
+// serveWorker serves the RPCs of one worker connection, which Serve has counted in connected
+func (c *Coordinator) serveWorker(conn net.Conn) {
+	defer c.connected.Done()
+	c.mu.Lock()
+	c.nextWorker++
+	service := &WorkerService{c, c.nextWorker, false}
+	c.mu.Unlock()
+	server := rpc.NewServer()
+	if err := server.RegisterName("Coordinator", service); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	server.ServeConn(conn)
+	c.release(service.id)
+}
+
+// release puts the tiles leased to a worker back in the queue
+func (c *Coordinator) release(worker int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for index, lease := range c.leases {
+		if lease.worker == worker {
+			delete(c.leases, index)
+			c.pending = append(c.pending, index)
+		}
+	}
+}
+
+// reclaimExpired puts tiles whose lease has run out back in the queue, c.mu must be held
+func (c *Coordinator) reclaimExpired() {
+	now := time.Now()
+	for index, lease := range c.leases {
+		if now.After(lease.expires) {
+			fmt.Fprintf(os.Stderr, "Lease on tile %d by worker %d expired, reissuing it\n", index, lease.worker)
+			delete(c.leases, index)
+			c.pending = append(c.pending, index)
+		}
+	}
+}
+
+// WorkerService is the RPC interface the coordinator offers a single worker connection
+type WorkerService struct {
+	c  *Coordinator
+	id int
+	// joined is set once the worker has joined with a matching hash, guarded by c.mu
+	joined bool
+}
+
+// errNotJoined refuses tile calls from a connection that hasn't joined
+var errNotJoined = errors.New("worker hasn't joined with the coordinator's scene and settings")
+
+// Join checks that the worker is rendering the same scene with the same settings. Tiles are only
+// handed to and taken from connections that have joined.
+func (s *WorkerService) Join(args JoinArgs, reply *bool) error {
+	if !bytes.Equal(args.Hash, s.c.hash) {
+		return errors.New("worker scene or settings differ from the coordinator's")
+	}
+	s.c.mu.Lock()
+	s.joined = true
+	s.c.mu.Unlock()
+	*reply = true
+	return nil
+}
+
+// NextTile leases the next tile to the worker
+func (s *WorkerService) NextTile(args struct{}, reply *TileAssignment) error {
+	c := s.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.joined {
+		return errNotJoined
+	}
+	c.reclaimExpired()
+	if c.remaining == 0 {
+		reply.Done = true
+		return nil
+	}
+	// Drop reissued tiles whose first lease holder got them in after all
+	for len(c.pending) > 0 && c.renderer.tileDone[c.pending[0]] {
+		c.pending = c.pending[1:]
+	}
+	switch {
+	case len(c.pending) == 0:
+		reply.Wait = true
+	default:
+		index := c.pending[0]
+		c.pending = c.pending[1:]
+		c.leases[index] = tileLease{s.id, time.Now().Add(c.lease)}
+		*reply = TileAssignment{false, false, index, c.renderer.pass, c.renderer.passSamples}
+	}
+	return nil
+}
+
+// SubmitTile merges the samples of a rendered tile into the framebuffer. Tiles the worker doesn't hold
+// the lease on, because it expired or was never given, are refused with a false reply.
+func (s *WorkerService) SubmitTile(result TileResult, reply *bool) error {
+	c := s.c
+	if result.Index < 0 || result.Index >= len(c.tiles) {
+		return fmt.Errorf("tile %d doesn't exist", result.Index)
+	}
+	r := c.tiles[result.Index]
+	n := (r.right - r.left) * (r.bottom - r.top)
+	if len(result.Pix) != 3*n || len(result.Lum) != n || len(result.Lum2) != n || len(result.Samples) != n {
+		return fmt.Errorf("tile %d has the wrong size", result.Index)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !s.joined {
+		return errNotJoined
+	}
+	renderer := c.renderer
+	// A reissued tile may come back twice, only the first copy counts
+	if c.remaining == 0 || renderer.tileDone[result.Index] {
+		*reply = true
+		return nil
+	}
+	if lease, ok := c.leases[result.Index]; !ok || lease.worker != s.id {
+		*reply = false
+		return nil
+	}
+	delete(c.leases, result.Index)
+	renderer.lock.Lock()
+	renderer.fb.addTile(r, &result)
+	renderer.tileDone[result.Index] = true
+	atomic.AddInt32(&renderer.tilesDone, 1)
+	renderer.lock.Unlock()
+	c.bar.Increment()
+	c.remaining--
+	if c.remaining == 0 {
+		close(c.finished)
+	}
+	*reply = true
+	return nil
+}
+
+// addTile adds the samples of a tile result to the pixels inside r
+func (fb *Framebuffer) addTile(r rect, result *TileResult) {
+	k := 0
+	for y := r.top; y < r.bottom; y++ {
+		for x := r.left; x < r.right; x++ {
+			i, j := fb.PixOffset(x, y), y*fb.Width+x
+			fb.Pix[i] += result.Pix[3*k]
+			fb.Pix[i+1] += result.Pix[3*k+1]
+			fb.Pix[i+2] += result.Pix[3*k+2]
+			fb.Lum[j] += result.Lum[k]
+			fb.Lum2[j] += result.Lum2[k]
+			fb.Samples[j] += result.Samples[k]
+			k++
+		}
+	}
+}
+
+// tileResult copies the samples of the pixels inside r
+func (fb *Framebuffer) tileResult(index int, r rect) TileResult {
+	n := (r.right - r.left) * (r.bottom - r.top)
+	result := TileResult{index, make([]float32, 0, 3*n), make([]float64, 0, n), make([]float64, 0, n),
+		make([]uint32, 0, n)}
+	for y := r.top; y < r.bottom; y++ {
+		i, j := fb.PixOffset(r.left, y), y*fb.Width+r.left
+		result.Pix = append(result.Pix, fb.Pix[i:i+3*(r.right-r.left)]...)
+		result.Lum = append(result.Lum, fb.Lum[j:j+r.right-r.left]...)
+		result.Lum2 = append(result.Lum2, fb.Lum2[j:j+r.right-r.left]...)
+		result.Samples = append(result.Samples, fb.Samples[j:j+r.right-r.left]...)
+	}
+	return result
+}
+
+// RenderRemote connects to the coordinator at addr and renders tiles for it until none are left.
+// The tiles must be the same as the coordinator's, which Join verifies through the hash.
+func (renderer *Renderer) RenderRemote(addr string, tiles []rect, hash []byte) error {
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := client.Close(); err != nil && err != rpc.ErrShutdown {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	var joined bool
+	if err := client.Call("Coordinator.Join", JoinArgs{hash}, &joined); err != nil {
+		return err
+	}
+	fmt.Printf("Joined coordinator at %s\n", addr)
+	// Tiles never overlap, so the worker's goroutines can share its framebuffer like local workers do
+	errs := make(chan error, renderer.workers)
+	for i := 0; i < renderer.workers; i++ {
+		go func() {
+			errs <- renderer.remoteWorker(client, tiles)
+		}()
+	}
+	for i := 0; i < renderer.workers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (renderer *Renderer) remoteWorker(client *rpc.Client, tiles []rect) error {
+	for {
+		var assignment TileAssignment
+		if err := client.Call("Coordinator.NextTile", struct{}{}, &assignment); err != nil {
+			return err
+		}
+		if assignment.Done {
+			return nil
+		}
+		if assignment.Wait {
+			time.Sleep(time.Second)
+			continue
+		}
+		r := tiles[assignment.Index]
+		// The tile may have been rendered here before, if its result was lost
+		renderer.fb.clearRect(r)
+		renderer.renderRect(&job{assignment.Index, r, assignment.Samples, assignment.Pass, 0, false})
+		var ok bool
+		if err := client.Call("Coordinator.SubmitTile", renderer.fb.tileResult(assignment.Index, r), &ok); err != nil {
+			return err
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Tile %d was refused, its lease ran out\n", assignment.Index)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// testRender returns the description of a small scene of spheres over a plane, the scene, its camera,
+// tiles and render hash
+func testRender(t *testing.T) (*SceneDescription, *Scene, *Camera, []rect, []byte) {
+	desc := defaultScene()
+	desc.Width, desc.Height, desc.Samples, desc.Meshes = 64, 48, 4, nil
+	desc.Planes = []PlaneDescription{{Point: Vec3{0, -2.5, 0}, Normal: Vec3{0, -1, 0}, Color: Vec3{0.8, 0.8, 0.8}}}
+	scene, camera, err := desc.Build(".", MeshCache{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiles := makeTiles(desc.Width, desc.Height, 16, OrderScanline)
+	settings := renderSettings{desc.Width, desc.Height, tiles, nil, desc.Samples, false, ProgressiveSettings{}}
+	return desc, scene, camera, tiles, renderHash(settings, camera, scene)
+}
+
+// TestDistributedRender renders with two workers over loopback, after a worker that leases tiles and
+// drops its connection, and checks the image and sample counts are those of a local render
+func TestDistributedRender(t *testing.T) {
+	desc, scene, camera, tiles, hash := testRender(t)
+	w, h := desc.Width, desc.Height
+	local := newRenderer(scene, camera, w, h)
+	local.RenderPass(tiles, desc.Samples, 0, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	coordinator := newRenderer(scene, camera, w, h)
+	c := newCoordinator(coordinator, tiles, desc.Samples, hash, time.Minute)
+	served := make(chan error, 1)
+	go func() { served <- c.serve(ln) }()
+
+	client, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assignment TileAssignment
+	if err := client.Call("Coordinator.NextTile", struct{}{}, &assignment); err == nil {
+		t.Error("a tile was leased before joining")
+	}
+	var ok bool
+	if err := client.Call("Coordinator.Join", JoinArgs{[]byte("another scene")}, &ok); err == nil {
+		t.Error("a worker joined with the wrong hash")
+	}
+	if err := client.Call("Coordinator.Join", JoinArgs{hash}, &ok); err != nil {
+		t.Fatal(err)
+	}
+	// Lease three tiles, then submit the first one twice and the third one's samples as another tile
+	leased := make([]int, 3)
+	for i := range leased {
+		if err := client.Call("Coordinator.NextTile", struct{}{}, &assignment); err != nil {
+			t.Fatal(err)
+		}
+		leased[i] = assignment.Index
+	}
+	rogue := newRenderer(scene, camera, w, h)
+	first := tiles[leased[0]]
+	rogue.renderRect(&job{leased[0], first, assignment.Samples, assignment.Pass, 0, false})
+	for i := 0; i < 2; i++ {
+		if err := client.Call("Coordinator.SubmitTile", rogue.fb.tileResult(leased[0], first), &ok); err != nil || !ok {
+			t.Fatalf("submission %d of a leased tile: %v, %v", i+1, ok, err)
+		}
+	}
+	unleased := len(tiles) - 1
+	if err := client.Call("Coordinator.SubmitTile", rogue.fb.tileResult(unleased, tiles[unleased]), &ok); err != nil || ok {
+		t.Fatalf("a tile that wasn't leased was accepted: %v, %v", ok, err)
+	}
+	// The tiles still leased go back in the queue when the connection drops
+	client.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c.mu.Lock()
+		requeued := 0
+		for _, index := range c.pending {
+			if index == leased[1] || index == leased[2] {
+				requeued++
+			}
+		}
+		leases := len(c.leases)
+		c.mu.Unlock()
+		if requeued == 2 && leases == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of the dropped worker's tiles were requeued, %d leases are left", requeued, leases)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	workers := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { workers <- newRenderer(scene, camera, w, h).RenderRemote(addr, tiles, hash) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-workers; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+	for i, n := range coordinator.fb.Samples {
+		if n != local.fb.Samples[i] {
+			t.Fatalf("pixel %d has %d samples, %d locally", i, n, local.fb.Samples[i])
+		}
+	}
+	if !bytes.Equal(coordinator.CreateImage().Pix, local.CreateImage().Pix) {
+		t.Error("the distributed image differs from the local one")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Framebuffer accumulates the linear color samples of every pixel in the image.
+// Workers write their tiles straight into it, tiles never overlap so no locking is needed.
+type Framebuffer struct {
+	// Pix holds the summed RGB samples of each pixel, three float32s per pixel in row-major order
+	Pix []float32
+	// Lum and Lum2 hold the summed luminance and squared luminance of each pixel's samples, in float64
+	// so the variance taken from their difference keeps its precision over many samples
+	Lum, Lum2 []float64
+	// Samples holds the number of samples taken for each pixel
+	Samples []uint32
+	Stride  int
+	Width   int
+	Height  int
+}
+
+func newFramebuffer(w, h int) *Framebuffer {
+	return &Framebuffer{make([]float32, w*h*3), make([]float64, w*h), make([]float64, w*h), make([]uint32, w*h), w * 3,
+		w, h}
+}
+
+// PixOffset returns the index of the first element of Pix for pixel (x, y)
+func (fb *Framebuffer) PixOffset(x, y int) int {
+	return y*fb.Stride + x*3
+}
+
+// Add accumulates the linear color sample c for pixel (x, y)
+func (fb *Framebuffer) Add(x, y int, c Vec3) {
+	i := fb.PixOffset(x, y)
+	fb.Pix[i] += float32(c.X)
+	fb.Pix[i+1] += float32(c.Y)
+	fb.Pix[i+2] += float32(c.Z)
+	l := c.luminance()
+	fb.Lum[y*fb.Width+x] += l
+	fb.Lum2[y*fb.Width+x] += l * l
+	fb.Samples[y*fb.Width+x]++
+}
+
+// SampleCount returns the number of samples taken for pixel (x, y)
+func (fb *Framebuffer) SampleCount(x, y int) int {
+	return int(fb.Samples[y*fb.Width+x])
+}
+
+// clearRect discards the samples of every pixel inside r
+func (fb *Framebuffer) clearRect(r rect) {
+	for y := r.top; y < r.bottom; y++ {
+		for x := r.left; x < r.right; x++ {
+			i, j := fb.PixOffset(x, y), y*fb.Width+x
+			fb.Pix[i], fb.Pix[i+1], fb.Pix[i+2] = 0, 0, 0
+			fb.Lum[j], fb.Lum2[j] = 0, 0
+			fb.Samples[j] = 0
+		}
+	}
+}
+
+// At returns the mean linear color of pixel (x, y)
+func (fb *Framebuffer) At(x, y int) Vec3 {
+	n := fb.Samples[y*fb.Width+x]
+	if n == 0 {
+		return zeroVec
+	}
+	i := fb.PixOffset(x, y)
+	return Vec3{float64(fb.Pix[i]), float64(fb.Pix[i+1]), float64(fb.Pix[i+2])}.Mul(1 / float64(n))
+}
+
+// Variance returns the sample variance of the luminance of pixel (x, y)
+func (fb *Framebuffer) Variance(x, y int) float64 {
+	j := y*fb.Width + x
+	n := float64(fb.Samples[j])
+	if n < 2 {
+		return 0
+	}
+	mean := fb.Lum[j] / n
+	return math.Max(0, (fb.Lum2[j]-n*mean*mean)/(n-1))
+}
+
+// RelativeError returns the standard error of the mean luminance of pixel (x, y) relative to that mean.
+// Pixels with fewer than two samples have an unknown error and report infinity.
+func (fb *Framebuffer) RelativeError(x, y int) float64 {
+	n := float64(fb.Samples[y*fb.Width+x])
+	if n < 2 {
+		return infinity
+	}
+	// The small constant keeps nearly black pixels from dominating
+	return math.Sqrt(fb.Variance(x, y)/n) / (fb.At(x, y).luminance() + 0.01)
+}
+
+// Noise estimates the noise left in the image as the mean RelativeError of the pixels sampled so far
+func (fb *Framebuffer) Noise() float64 {
+	total, n := 0.0, 0
+	for y := 0; y < fb.Height; y++ {
+		for x := 0; x < fb.Width; x++ {
+			if fb.SampleCount(x, y) > 0 {
+				total += fb.RelativeError(x, y)
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return infinity
+	}
+	return total / float64(n)
+}
+
+// Image converts the framebuffer to an sRGB image, rows are converted in parallel
+func (fb *Framebuffer) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, fb.Width, fb.Height))
+	rows := make(chan int, fb.Height)
+	for y := 0; y < fb.Height; y++ {
+		rows <- y
+	}
+	close(rows)
+	var done sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			for y := range rows {
+				fb.convertRow(img, y)
+			}
+		}()
+	}
+	done.Wait()
+	return img
+}
+
+func (fb *Framebuffer) convertRow(img *image.RGBA, y int) {
+	for x := 0; x < fb.Width; x++ {
+		c := fb.At(x, y)
+		c.linearToSRGB()
+		i := img.PixOffset(x, y)
+		img.Pix[i] = ratioToByte(c.X)
+		img.Pix[i+1] = ratioToByte(c.Y)
+		img.Pix[i+2] = ratioToByte(c.Z)
+		img.Pix[i+3] = 255
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// renderTiles calls sample for every pixel of tiles from NumCPU workers
+func renderTiles(tiles []rect, sample func(x, y int)) {
+	jobs := make(chan rect, len(tiles))
+	for _, r := range tiles {
+		jobs <- r
+	}
+	close(jobs)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				for y := r.top; y < r.bottom; y++ {
+					for x := r.left; x < r.right; x++ {
+						sample(x, y)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkFramebuffer accumulates one sample per pixel of a 1920x1080 image and resolves it to sRGB,
+// through the Framebuffer and through the channel of Pixels it replaced
+func BenchmarkFramebuffer(b *testing.B) {
+	w, h := 1920, 1080
+	tiles := makeTiles(w, h, 40, OrderScanline)
+	c := Vec3{0.2, 0.4, 0.6}
+	b.Run("framebuffer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fb := newFramebuffer(w, h)
+			renderTiles(tiles, func(x, y int) { fb.Add(x, y, c) })
+			fb.Image()
+		}
+	})
+	b.Run("pixel channel", func(b *testing.B) {
+		type pixel struct {
+			x, y  int
+			color color.Color
+		}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			pixels := make(chan pixel, w*h)
+			renderTiles(tiles, func(x, y int) {
+				g := c
+				g.linearToSRGB()
+				pixels <- pixel{x, y, color.RGBA64{ratioToColor(g.X), ratioToColor(g.Y), ratioToColor(g.Z), 65535}}
+			})
+			close(pixels)
+			img := image.NewRGBA(image.Rect(0, 0, w, h))
+			for p := range pixels {
+				img.Set(p.x, p.y, p.color)
+			}
+		}
+	})
+}
@@ -0,0 +1,864 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A glTF scene is flattened into one Mesh, with a MeshGroup for every primitive of every node, in
+// the space of its camera. goray cameras sit at the origin looking down +z with y up, while glTF
+// cameras look down -z, so the view transform also mirrors z and flips the winding of the triangles.
+
+// glbMagic, glbJSON and glbBIN are the magic number of a binary glTF file and its chunk types
+const (
+	glbMagic = 0x46546C67
+	glbJSON  = 0x4E4F534A
+	glbBIN   = 0x004E4942
+)
+
+// gltfExtensions are the extensions a file may require and still be loaded
+var gltfExtensions = map[string]bool{"KHR_lights_punctual": true, "KHR_materials_emissive_strength": true}
+
+// gltfComponentSizes maps accessor component types to their sizes in bytes
+var gltfComponentSizes = map[int]int{5120: 1, 5121: 1, 5122: 2, 5123: 2, 5125: 4, 5126: 4}
+
+// gltfComponentCounts maps accessor types to their number of components
+var gltfComponentCounts = map[string]int{"SCALAR": 1, "VEC2": 2, "VEC3": 3, "VEC4": 4, "MAT2": 4, "MAT3": 9, "MAT4": 16}
+
+// gltfWrapModes maps sampler wrap modes to ours
+var gltfWrapModes = map[int]WrapMode{10497: WrapRepeat, 33071: WrapClamp, 33648: WrapMirror}
+
+type gltfDocument struct {
+	Asset struct {
+		Version string `json:"version"`
+	} `json:"asset"`
+	ExtensionsRequired []string `json:"extensionsRequired"`
+	Scene              *int     `json:"scene"`
+	Scenes             []struct {
+		Nodes []int `json:"nodes"`
+	} `json:"scenes"`
+	Nodes       []gltfNode       `json:"nodes"`
+	Meshes      []gltfMesh       `json:"meshes"`
+	Accessors   []gltfAccessor   `json:"accessors"`
+	BufferViews []gltfBufferView `json:"bufferViews"`
+	Buffers     []gltfBuffer     `json:"buffers"`
+	Materials   []gltfMaterial   `json:"materials"`
+	Textures    []gltfTexture    `json:"textures"`
+	Images      []gltfImage      `json:"images"`
+	Samplers    []gltfSampler    `json:"samplers"`
+	Cameras     []gltfCamera     `json:"cameras"`
+	Extensions  struct {
+		Lights *struct {
+			Lights []gltfLight `json:"lights"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type gltfNode struct {
+	Name        string    `json:"name"`
+	Children    []int     `json:"children"`
+	Mesh        *int      `json:"mesh"`
+	Camera      *int      `json:"camera"`
+	Matrix      []float64 `json:"matrix"`
+	Translation []float64 `json:"translation"`
+	Rotation    []float64 `json:"rotation"`
+	Scale       []float64 `json:"scale"`
+	Extensions  struct {
+		Light *struct {
+			Light int `json:"light"`
+		} `json:"KHR_lights_punctual"`
+	} `json:"extensions"`
+}
+
+type gltfMesh struct {
+	Name       string          `json:"name"`
+	Primitives []gltfPrimitive `json:"primitives"`
+}
+
+type gltfPrimitive struct {
+	Attributes map[string]int `json:"attributes"`
+	Indices    *int           `json:"indices"`
+	Material   *int           `json:"material"`
+	Mode       *int           `json:"mode"`
+}
+
+type gltfAccessor struct {
+	BufferView    *int            `json:"bufferView"`
+	ByteOffset    int             `json:"byteOffset"`
+	ComponentType int             `json:"componentType"`
+	Normalized    bool            `json:"normalized"`
+	Count         int             `json:"count"`
+	Type          string          `json:"type"`
+	Sparse        json.RawMessage `json:"sparse"`
+}
+
+type gltfBufferView struct {
+	Buffer     int `json:"buffer"`
+	ByteOffset int `json:"byteOffset"`
+	ByteLength int `json:"byteLength"`
+	ByteStride int `json:"byteStride"`
+}
+
+type gltfBuffer struct {
+	URI        string `json:"uri"`
+	ByteLength int    `json:"byteLength"`
+}
+
+type gltfMaterial struct {
+	Name string `json:"name"`
+	PBR  struct {
+		BaseColorFactor  []float64       `json:"baseColorFactor"`
+		BaseColorTexture *gltfTextureRef `json:"baseColorTexture"`
+		MetallicFactor   *float64        `json:"metallicFactor"`
+		RoughnessFactor  *float64        `json:"roughnessFactor"`
+	} `json:"pbrMetallicRoughness"`
+	NormalTexture  *gltfTextureRef `json:"normalTexture"`
+	EmissiveFactor []float64       `json:"emissiveFactor"`
+	AlphaMode      string          `json:"alphaMode"`
+	DoubleSided    bool            `json:"doubleSided"`
+	Extensions     struct {
+		EmissiveStrength *struct {
+			EmissiveStrength float64 `json:"emissiveStrength"`
+		} `json:"KHR_materials_emissive_strength"`
+	} `json:"extensions"`
+}
+
+type gltfTextureRef struct {
+	Index    int `json:"index"`
+	TexCoord int `json:"texCoord"`
+}
+
+type gltfTexture struct {
+	Sampler *int `json:"sampler"`
+	Source  *int `json:"source"`
+}
+
+type gltfImage struct {
+	URI        string `json:"uri"`
+	BufferView *int   `json:"bufferView"`
+}
+
+type gltfSampler struct {
+	WrapS int `json:"wrapS"`
+}
+
+type gltfCamera struct {
+	Type        string `json:"type"`
+	Perspective *struct {
+		YFov float64 `json:"yfov"`
+	} `json:"perspective"`
+}
+
+type gltfLight struct {
+	Type      string    `json:"type"`
+	Color     []float64 `json:"color"`
+	Intensity *float64  `json:"intensity"`
+}
+
+// GLTFScene is what goray renders of a glTF scene, in the space of its camera
+type GLTFScene struct {
+	Mesh *Mesh
+	// FOV is the vertical field of view of the camera in degrees
+	FOV float64
+	// Light is the first directional light of the scene, with no direction if there is none
+	Light Light
+}
+
+// gltfLoader holds the state of a glTF file being read
+type gltfLoader struct {
+	path    string
+	doc     gltfDocument
+	buffers [][]byte
+	// materials and images are converted once, by index. Images are keyed by index and color space.
+	materials map[int]*Material
+	images    map[textureKey]*ImageTexture
+	// m holds the triangles of the scene, in world space until OpenGLTF moves them to the view
+	m      *Mesh
+	groups []MeshGroup
+	// camera and light are the world transforms of the first camera and directional light found
+	camera, light *Matrix
+	cameraFOV     float64
+	lightInfo     gltfLight
+	// visited marks the nodes already added, since each may be reached only once
+	visited []bool
+	// skipped counts the primitives and lights that can't be rendered, by kind
+	skipped map[string]int
+}
+
+// OpenGLTF reads the default scene of a .gltf or .glb file. Without a camera in the scene, one is
+// placed in front of the scene, looking down -z in glTF space, with a vertical field of view of fov
+// degrees.
+//
+// Materials are approximated: the diffuse color is the base color of dielectrics, the specular color
+// blends from 4% to the base color with metalness, the specular exponent follows roughness, and
+// smooth surfaces reflect. Directional lights are supported, and the intensity of the first is
+// converted from lux so a white surface facing it is as bright as in glTF. As in glTF, the backs of
+// triangles are culled unless their material is double-sided.
+func OpenGLTF(path string, fov float64) (*GLTFScene, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &gltfLoader{path: path, materials: make(map[int]*Material), images: make(map[textureKey]*ImageTexture),
+		m: newMesh(), skipped: make(map[string]int)}
+	if err := l.load(data); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for kind, n := range l.skipped {
+		fmt.Fprintf(os.Stderr, "%s: skipped %d %s\n", path, n, kind)
+	}
+	if len(l.m.faces) == 0 {
+		return nil, fmt.Errorf("%s: the scene has no triangles", path)
+	}
+	// The view maps glTF space to camera space, mirroring z
+	var view Matrix
+	if l.camera != nil {
+		view = Scale(Vec3{1, 1, -1}).Mul(l.camera.Inverse())
+		fov = l.cameraFOV
+	} else {
+		view = Scale(Vec3{1, 1, -1}).Mul(l.frame(fov).Inverse())
+	}
+	l.m.Transform(view)
+	l.m.groups = l.groups
+	l.m.culling = CullBack
+	l.m.build()
+	scene := &GLTFScene{l.m, fov, Light{}}
+	if l.light != nil {
+		intensity := 1.0
+		if l.lightInfo.Intensity != nil {
+			intensity = *l.lightInfo.Intensity
+		}
+		if len(l.lightInfo.Color) == 3 {
+			intensity *= Vec3{l.lightInfo.Color[0], l.lightInfo.Color[1], l.lightInfo.Color[2]}.luminance()
+		}
+		// Lights point down -z of their node. goray lights a white surface with 0.18 of their intensity.
+		direction := view.Mul(*l.light).MulDirection(Vec3{0, 0, -1})
+		scene.Light = Light{direction, intensity / 0.18}
+	}
+	return scene, nil
+}
+
+// load parses a .gltf or .glb file and gathers the triangles of its default scene in glTF space
+func (l *gltfLoader) load(data []byte) error {
+	jsonChunk := data
+	var bin []byte
+	if len(data) >= 12 && binary.LittleEndian.Uint32(data) == glbMagic {
+		var err error
+		if jsonChunk, bin, err = splitGLB(data); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(jsonChunk, &l.doc); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(l.doc.Asset.Version, "2.") {
+		return fmt.Errorf("glTF version %q isn't supported, only 2.x", l.doc.Asset.Version)
+	}
+	for _, ext := range l.doc.ExtensionsRequired {
+		if !gltfExtensions[ext] {
+			return fmt.Errorf("requires unsupported extension %s", ext)
+		}
+	}
+	l.buffers = make([][]byte, len(l.doc.Buffers))
+	for i, b := range l.doc.Buffers {
+		var err error
+		if b.URI == "" && i == 0 && bin != nil {
+			l.buffers[i] = bin
+		} else if l.buffers[i], err = l.readURI(b.URI); err != nil {
+			return fmt.Errorf("buffer %d: %v", i, err)
+		}
+		if len(l.buffers[i]) < b.ByteLength {
+			return fmt.Errorf("buffer %d has %d bytes, not %d", i, len(l.buffers[i]), b.ByteLength)
+		}
+	}
+	var roots []int
+	if len(l.doc.Scenes) > 0 {
+		scene := 0
+		if l.doc.Scene != nil {
+			scene = *l.doc.Scene
+		}
+		if scene < 0 || scene >= len(l.doc.Scenes) {
+			return fmt.Errorf("scene %d doesn't exist", scene)
+		}
+		roots = l.doc.Scenes[scene].Nodes
+	} else {
+		// Without scenes, every node that isn't a child is a root
+		child := make(map[int]bool)
+		for _, n := range l.doc.Nodes {
+			for _, c := range n.Children {
+				child[c] = true
+			}
+		}
+		for i := range l.doc.Nodes {
+			if !child[i] {
+				roots = append(roots, i)
+			}
+		}
+	}
+	l.visited = make([]bool, len(l.doc.Nodes))
+	for _, root := range roots {
+		if err := l.node(root, Identity()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitGLB returns the JSON and binary chunks of a .glb file
+func splitGLB(data []byte) ([]byte, []byte, error) {
+	if version := binary.LittleEndian.Uint32(data[4:]); version != 2 {
+		return nil, nil, fmt.Errorf("GLB version %d isn't supported", version)
+	}
+	if length := binary.LittleEndian.Uint32(data[8:]); uint64(length) > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("GLB file is truncated")
+	}
+	var jsonChunk, bin []byte
+	for rest := data[12:]; len(rest) >= 8; {
+		length := uint64(binary.LittleEndian.Uint32(rest))
+		kind := binary.LittleEndian.Uint32(rest[4:])
+		if length > uint64(len(rest)-8) {
+			return nil, nil, fmt.Errorf("GLB chunk is truncated")
+		}
+		chunk := rest[8 : 8+length]
+		switch {
+		case kind == glbJSON && jsonChunk == nil:
+			jsonChunk = chunk
+		case kind == glbBIN && bin == nil:
+			bin = chunk
+		}
+		rest = rest[8+length:]
+	}
+	if jsonChunk == nil {
+		return nil, nil, fmt.Errorf("GLB file has no JSON chunk")
+	}
+	return jsonChunk, bin, nil
+}
+
+// readURI returns the data of a base64 data URI, or of a file relative to the glTF file. Files
+// outside the directory of the glTF file aren't read.
+func (l *gltfLoader) readURI(uri string) ([]byte, error) {
+	if strings.HasPrefix(uri, "data:") {
+		comma := strings.IndexByte(uri, ',')
+		if comma < 0 || !strings.HasSuffix(uri[:comma], ";base64") {
+			return nil, fmt.Errorf("only base64 data URIs are supported")
+		}
+		return base64.StdEncoding.DecodeString(uri[comma+1:])
+	}
+	name, err := url.PathUnescape(uri)
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.FromSlash(name)
+	if name == "" || filepath.IsAbs(name) || !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("%q isn't a file next to the glTF file", uri)
+	}
+	return os.ReadFile(filepath.Join(filepath.Dir(l.path), name))
+}
+
+// node adds the triangles of node i and its descendants, parent being the transform of its parent
+func (l *gltfLoader) node(i int, parent Matrix) error {
+	if i < 0 || i >= len(l.doc.Nodes) {
+		return fmt.Errorf("node %d doesn't exist", i)
+	}
+	// Node graphs must be disjoint trees. A node reached twice has two parents or is in a cycle, and
+	// walking every path to it could take time exponential in the number of nodes.
+	if l.visited[i] {
+		return fmt.Errorf("node %d is reached twice, the node graph isn't a tree", i)
+	}
+	l.visited[i] = true
+	n := l.doc.Nodes[i]
+	local, err := n.transform()
+	if err != nil {
+		return fmt.Errorf("node %d: %v", i, err)
+	}
+	world := parent.Mul(local)
+	if n.Mesh != nil {
+		if err := l.mesh(*n.Mesh, n.Name, world); err != nil {
+			return fmt.Errorf("node %d: %v", i, err)
+		}
+	}
+	if n.Camera != nil && l.camera == nil {
+		if *n.Camera < 0 || *n.Camera >= len(l.doc.Cameras) {
+			return fmt.Errorf("node %d: camera %d doesn't exist", i, *n.Camera)
+		}
+		if c := l.doc.Cameras[*n.Camera]; c.Type == "perspective" && c.Perspective != nil && c.Perspective.YFov > 0 {
+			l.camera = &world
+			l.cameraFOV = c.Perspective.YFov * 180 / math.Pi
+		} else {
+			l.skipped["orthographic cameras"]++
+		}
+	}
+	if ref := n.Extensions.Light; ref != nil {
+		if l.doc.Extensions.Lights == nil || ref.Light < 0 || ref.Light >= len(l.doc.Extensions.Lights.Lights) {
+			return fmt.Errorf("node %d: light %d doesn't exist", i, ref.Light)
+		}
+		light := l.doc.Extensions.Lights.Lights[ref.Light]
+		switch {
+		case light.Type != "directional":
+			l.skipped[light.Type+" lights"]++
+		case l.light == nil:
+			l.light = &world
+			l.lightInfo = light
+		default:
+			l.skipped["directional lights after the first"]++
+		}
+	}
+	for _, child := range n.Children {
+		if err := l.node(child, world); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transform returns the local transform of a node, its matrix or its translation, rotation and scale
+func (n *gltfNode) transform() (Matrix, error) {
+	if n.Matrix != nil {
+		if len(n.Matrix) != 16 {
+			return Matrix{}, fmt.Errorf("matrix has %d values", len(n.Matrix))
+		}
+		m := n.Matrix
+		// glTF matrices are column major
+		return Matrix{
+			m[0], m[4], m[8], m[12],
+			m[1], m[5], m[9], m[13],
+			m[2], m[6], m[10], m[14],
+			m[3], m[7], m[11], m[15]}, nil
+	}
+	t, r, s := Vec3{}, [4]float64{0, 0, 0, 1}, Vec3{1, 1, 1}
+	if n.Translation != nil {
+		if len(n.Translation) != 3 {
+			return Matrix{}, fmt.Errorf("translation has %d values", len(n.Translation))
+		}
+		t = Vec3{n.Translation[0], n.Translation[1], n.Translation[2]}
+	}
+	if n.Rotation != nil {
+		if len(n.Rotation) != 4 {
+			return Matrix{}, fmt.Errorf("rotation has %d values", len(n.Rotation))
+		}
+		copy(r[:], n.Rotation)
+	}
+	if n.Scale != nil {
+		if len(n.Scale) != 3 {
+			return Matrix{}, fmt.Errorf("scale has %d values", len(n.Scale))
+		}
+		s = Vec3{n.Scale[0], n.Scale[1], n.Scale[2]}
+	}
+	return Translate(t).Mul(quaternionMatrix(r)).Mul(Scale(s)), nil
+}
+
+// quaternionMatrix returns the rotation of the unit quaternion q, stored x, y, z, w
+func quaternionMatrix(q [4]float64) Matrix {
+	x, y, z, w := q[0], q[1], q[2], q[3]
+	return Matrix{
+		1 - 2*(y*y+z*z), 2 * (x*y - z*w), 2 * (x*z + y*w), 0,
+		2 * (x*y + z*w), 1 - 2*(x*x+z*z), 2 * (y*z - x*w), 0,
+		2 * (x*z - y*w), 2 * (y*z + x*w), 1 - 2*(x*x+y*y), 0,
+		0, 0, 0, 1}
+}
+
+// mesh adds the triangles of the primitives of mesh i, transformed by world
+func (l *gltfLoader) mesh(i int, nodeName string, world Matrix) error {
+	if i < 0 || i >= len(l.doc.Meshes) {
+		return fmt.Errorf("mesh %d doesn't exist", i)
+	}
+	mesh := l.doc.Meshes[i]
+	for j, p := range mesh.Primitives {
+		first := len(l.m.faces)
+		material, err := l.material(p.Material)
+		if err != nil {
+			return fmt.Errorf("mesh %d primitive %d: %v", i, j, err)
+		}
+		if err := l.primitive(p, material, world); err != nil {
+			return fmt.Errorf("mesh %d primitive %d: %v", i, j, err)
+		}
+		if count := len(l.m.faces) - first; count > 0 {
+			l.groups = append(l.groups, MeshGroup{nodeName, mesh.Name, material, first, count})
+		}
+	}
+	return nil
+}
+
+// primitive adds the vertices of a primitive transformed by world, and the triangles between them
+func (l *gltfLoader) primitive(p gltfPrimitive, material *Material, world Matrix) error {
+	mode := 4
+	if p.Mode != nil {
+		mode = *p.Mode
+	}
+	if mode < 4 || mode > 6 {
+		l.skipped["point and line primitives"]++
+		return nil
+	}
+	position, ok := p.Attributes["POSITION"]
+	if !ok {
+		return fmt.Errorf("no POSITION attribute")
+	}
+	positions, err := l.accessor(position, 3, 3)
+	if err != nil {
+		return fmt.Errorf("POSITION: %v", err)
+	}
+	count := len(positions) / 3
+	attribute := func(name string, min, max int) ([]float64, int, error) {
+		i, ok := p.Attributes[name]
+		if !ok {
+			return nil, 0, nil
+		}
+		values, err := l.accessor(i, min, max)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", name, err)
+		}
+		size := len(values) / maxInt(count, 1)
+		if len(values) != size*count {
+			return nil, 0, fmt.Errorf("%s has %d values for %d vertices", name, len(values), count)
+		}
+		return values, size, nil
+	}
+	normals, _, err := attribute("NORMAL", 3, 3)
+	if err != nil {
+		return err
+	}
+	uvs, _, err := attribute("TEXCOORD_0", 2, 2)
+	if err != nil {
+		return err
+	}
+	colors, colorSize, err := attribute("COLOR_0", 3, 4)
+	if err != nil {
+		return err
+	}
+	var indices []int
+	if p.Indices != nil {
+		values, err := l.accessor(*p.Indices, 1, 1)
+		if err != nil {
+			return fmt.Errorf("indices: %v", err)
+		}
+		indices = make([]int, len(values))
+		for i, v := range values {
+			if v < 0 || v >= float64(count) {
+				return fmt.Errorf("index %v is out of range, there are %d vertices", v, count)
+			}
+			indices[i] = int(v)
+		}
+	} else {
+		indices = make([]int, count)
+		for i := range indices {
+			indices[i] = i
+		}
+	}
+	m := l.m
+	first := uint32(len(m.positions))
+	for i := 0; i < count; i++ {
+		m.positions = append(m.positions, world.MulPoint(Vec3{positions[3*i], positions[3*i+1], positions[3*i+2]}))
+	}
+	var firstNormal, firstUV uint32
+	if normals != nil {
+		firstNormal = uint32(len(m.normals))
+		transform := world.Inverse().Transpose()
+		for i := 0; i < count; i++ {
+			n := Vec3{normals[3*i], normals[3*i+1], normals[3*i+2]}
+			if n != zeroVec {
+				n = transform.MulDirection(n)
+			}
+			m.normals = append(m.normals, n)
+		}
+	}
+	if uvs != nil {
+		firstUV = uint32(len(m.uvs))
+		for i := 0; i < count; i++ {
+			// glTF texture coordinates run down the image
+			m.uvs = append(m.uvs, Vec3{uvs[2*i], 1 - uvs[2*i+1], 0})
+		}
+	}
+	if colors != nil {
+		vertexColors := make([]Vec3, count)
+		for i := range vertexColors {
+			c := colors[colorSize*i:]
+			vertexColors[i] = Vec3{c[0], c[1], c[2]}
+		}
+		m.addColors(int(first), vertexColors)
+	}
+	index := m.addMaterial(material)
+	mirrored := world.Determinant() < 0
+	add := func(a, b, c int) {
+		f := meshFace{Material: index}
+		for j, i := range []int{a, b, c} {
+			f.V[j] = first + uint32(i)
+			if normals != nil {
+				f.N[j] = firstNormal + uint32(i)
+			}
+			if uvs != nil {
+				f.T[j] = firstUV + uint32(i)
+			}
+		}
+		v := m.positions
+		if crossProduct(v[f.V[1]].Sub(v[f.V[0]]), v[f.V[2]].Sub(v[f.V[0]])) == zeroVec {
+			return
+		}
+		// A mirroring transform turns the triangles inside out, so their winding is reversed
+		if mirrored {
+			f.flip()
+		}
+		m.faces = append(m.faces, f)
+	}
+	switch mode {
+	case 4:
+		for i := 0; i+2 < len(indices); i += 3 {
+			add(indices[i], indices[i+1], indices[i+2])
+		}
+	case 5:
+		// Every other triangle of a strip is reversed to keep the winding
+		for i := 0; i+2 < len(indices); i++ {
+			if i%2 == 0 {
+				add(indices[i], indices[i+1], indices[i+2])
+			} else {
+				add(indices[i+1], indices[i], indices[i+2])
+			}
+		}
+	case 6:
+		for i := 1; i+1 < len(indices); i++ {
+			add(indices[0], indices[i], indices[i+1])
+		}
+	}
+	return nil
+}
+
+// accessor returns the values of accessor i, which must have between min and max components,
+// converted to float64 and normalized if the accessor asks for it
+func (l *gltfLoader) accessor(i, min, max int) ([]float64, error) {
+	if i < 0 || i >= len(l.doc.Accessors) {
+		return nil, fmt.Errorf("accessor %d doesn't exist", i)
+	}
+	a := l.doc.Accessors[i]
+	components, ok := gltfComponentCounts[a.Type]
+	if !ok || components < min || components > max {
+		return nil, fmt.Errorf("accessor %d has unexpected type %q", i, a.Type)
+	}
+	size, ok := gltfComponentSizes[a.ComponentType]
+	if !ok {
+		return nil, fmt.Errorf("accessor %d has unknown component type %d", i, a.ComponentType)
+	}
+	if len(a.Sparse) > 0 {
+		return nil, fmt.Errorf("accessor %d is sparse, which isn't supported", i)
+	}
+	if a.Count < 0 || a.ByteOffset < 0 {
+		return nil, fmt.Errorf("accessor %d has a negative count or offset", i)
+	}
+	if a.BufferView == nil {
+		// An accessor without a buffer view is all zeros, and its size isn't bounded by any data
+		if a.Count > 1<<24 {
+			return nil, fmt.Errorf("accessor %d is too big", i)
+		}
+		return make([]float64, a.Count*components), nil
+	}
+	if *a.BufferView < 0 || *a.BufferView >= len(l.doc.BufferViews) {
+		return nil, fmt.Errorf("accessor %d: buffer view %d doesn't exist", i, *a.BufferView)
+	}
+	view := l.doc.BufferViews[*a.BufferView]
+	if view.Buffer < 0 || view.Buffer >= len(l.buffers) {
+		return nil, fmt.Errorf("accessor %d: buffer %d doesn't exist", i, view.Buffer)
+	}
+	buffer := l.buffers[view.Buffer]
+	if view.ByteOffset < 0 || view.ByteLength < 0 || int64(view.ByteOffset)+int64(view.ByteLength) > int64(len(buffer)) {
+		return nil, fmt.Errorf("accessor %d: buffer view %d is outside its buffer", i, *a.BufferView)
+	}
+	data := buffer[view.ByteOffset : view.ByteOffset+view.ByteLength]
+	element := int64(size * components)
+	stride := element
+	if view.ByteStride > 0 {
+		stride = int64(view.ByteStride)
+	}
+	if a.Count > 0 && int64(a.ByteOffset)+stride*int64(a.Count-1)+element > int64(len(data)) {
+		return nil, fmt.Errorf("accessor %d is outside its buffer view", i)
+	}
+	values := make([]float64, 0, a.Count*components)
+	for e := 0; e < a.Count; e++ {
+		b := data[int64(a.ByteOffset)+stride*int64(e):]
+		for c := 0; c < components; c++ {
+			values = append(values, gltfComponent(b[c*size:], a.ComponentType, a.Normalized))
+		}
+	}
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("accessor %d has values that aren't finite", i)
+		}
+	}
+	return values, nil
+}
+
+// gltfComponent reads a component of type t from b
+func gltfComponent(b []byte, t int, normalized bool) float64 {
+	var v, max float64
+	switch t {
+	case 5120:
+		v, max = float64(int8(b[0])), math.MaxInt8
+	case 5121:
+		v, max = float64(b[0]), math.MaxUint8
+	case 5122:
+		v, max = float64(int16(binary.LittleEndian.Uint16(b))), math.MaxInt16
+	case 5123:
+		v, max = float64(binary.LittleEndian.Uint16(b)), math.MaxUint16
+	case 5125:
+		v, max = float64(binary.LittleEndian.Uint32(b)), math.MaxUint32
+	default:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	}
+	if normalized {
+		return math.Max(v/max, -1)
+	}
+	return v
+}
+
+// material returns the material with index i, converting it on first use. Primitives without a
+// material have none, and use the mesh color.
+func (l *gltfLoader) material(i *int) (*Material, error) {
+	if i == nil {
+		return nil, nil
+	}
+	if m, ok := l.materials[*i]; ok {
+		return m, nil
+	}
+	if *i < 0 || *i >= len(l.doc.Materials) {
+		return nil, fmt.Errorf("material %d doesn't exist", *i)
+	}
+	g := l.doc.Materials[*i]
+	base, alpha := Vec3{1, 1, 1}, 1.0
+	if f := g.PBR.BaseColorFactor; len(f) == 4 {
+		base, alpha = Vec3{f[0], f[1], f[2]}, f[3]
+	}
+	metallic, roughness := 1.0, 1.0
+	if g.PBR.MetallicFactor != nil {
+		metallic = *g.PBR.MetallicFactor
+	}
+	if g.PBR.RoughnessFactor != nil {
+		roughness = *g.PBR.RoughnessFactor
+	}
+	name := g.Name
+	if name == "" {
+		name = fmt.Sprintf("material %d", *i)
+	}
+	m := newMaterial(name)
+	m.Diffuse = base.Mul(1 - metallic)
+	m.Specular = Vec3{0.04, 0.04, 0.04}.Mul(1 - metallic).Add(base.Mul(metallic))
+	// The Blinn-Phong exponent whose highlight matches a GGX lobe of the same roughness
+	a := math.Max(roughness*roughness, 0.01)
+	m.Shininess = 2/(a*a) - 2
+	if roughness < 0.2 {
+		m.Illum = 3
+	}
+	if f := g.EmissiveFactor; len(f) == 3 {
+		m.Emission = Vec3{f[0], f[1], f[2]}
+		if s := g.Extensions.EmissiveStrength; s != nil {
+			m.Emission = m.Emission.Mul(s.EmissiveStrength)
+		}
+	}
+	if g.AlphaMode == "BLEND" {
+		m.Opacity = alpha
+	}
+	m.DoubleSided = g.DoubleSided
+	for keyword, ref := range map[string]*gltfTextureRef{"map_kd": g.PBR.BaseColorTexture, "map_norm": g.NormalTexture} {
+		if ref == nil {
+			continue
+		}
+		if ref.TexCoord != 0 {
+			l.skipped["textures on texture coordinates other than TEXCOORD_0"]++
+			continue
+		}
+		tm, err := l.texture(ref.Index, renderedMaps[keyword])
+		if err != nil {
+			return nil, fmt.Errorf("material %d: %v", *i, err)
+		}
+		m.Maps[keyword] = tm
+	}
+	l.materials[*i] = m
+	return m, nil
+}
+
+// texture returns texture i as a texture map, decoding its image as sRGB or linear data
+func (l *gltfLoader) texture(i int, srgb bool) (TextureMap, error) {
+	if i < 0 || i >= len(l.doc.Textures) {
+		return TextureMap{}, fmt.Errorf("texture %d doesn't exist", i)
+	}
+	t := l.doc.Textures[i]
+	tm := TextureMap{Scale: Vec3{1, 1, 1}}
+	if t.Sampler != nil {
+		if *t.Sampler < 0 || *t.Sampler >= len(l.doc.Samplers) {
+			return tm, fmt.Errorf("sampler %d doesn't exist", *t.Sampler)
+		}
+		tm.Wrap = gltfWrapModes[l.doc.Samplers[*t.Sampler].WrapS]
+	}
+	if t.Source == nil {
+		return tm, fmt.Errorf("texture %d has no image", i)
+	}
+	source := *t.Source
+	if source < 0 || source >= len(l.doc.Images) {
+		return tm, fmt.Errorf("image %d doesn't exist", source)
+	}
+	tm.Path = fmt.Sprintf("%s#image%d", l.path, source)
+	key := textureKey{tm.Path, srgb}
+	if img, ok := l.images[key]; ok {
+		tm.Image = img
+		return tm, nil
+	}
+	var data []byte
+	var err error
+	if ref := l.doc.Images[source]; ref.BufferView != nil {
+		if *ref.BufferView < 0 || *ref.BufferView >= len(l.doc.BufferViews) {
+			return tm, fmt.Errorf("image %d: buffer view %d doesn't exist", source, *ref.BufferView)
+		}
+		view := l.doc.BufferViews[*ref.BufferView]
+		if view.Buffer < 0 || view.Buffer >= len(l.buffers) || view.ByteOffset < 0 || view.ByteLength < 0 ||
+			int64(view.ByteOffset)+int64(view.ByteLength) > int64(len(l.buffers[view.Buffer])) {
+			return tm, fmt.Errorf("image %d is outside its buffer", source)
+		}
+		data = l.buffers[view.Buffer][view.ByteOffset : view.ByteOffset+view.ByteLength]
+	} else if data, err = l.readURI(ref.URI); err != nil {
+		return tm, fmt.Errorf("image %d: %v", source, err)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return tm, fmt.Errorf("image %d: %v", source, err)
+	}
+	if decoded.Bounds().Empty() {
+		return tm, fmt.Errorf("image %d is empty", source)
+	}
+	tm.Image = newImageTexture(decoded, srgb)
+	l.images[key] = tm.Image
+	return tm, nil
+}
+
+// frame returns the transform of a camera looking down -z at the whole scene with a vertical field
+// of view of fov degrees
+func (l *gltfLoader) frame(fov float64) Matrix {
+	box, err := computeBoundingBox(l.m.positions[1:])
+	if err != nil {
+		return Identity()
+	}
+	centre := box.min.Add(box.max).Mul(0.5)
+	radius := box.max.Sub(box.min).Magnitude() / 2
+	distance := radius / math.Sin(degToRad(fov)/2)
+	return Translate(centre.Add(Vec3{0, 0, distance}))
+}
@@ -1,13 +1,24 @@
 package main
 
 // NoHit is a const that is used when rays miss
-var NoHit = Hit{infinity, zeroVec, zeroVec}
+var NoHit = Hit{infinity, zeroVec, zeroVec, zeroVec, nil, nil, 0, nil, zeroVec, zeroVec}
 
 // Hit represents a hit if one occurs
 type Hit struct {
 	T      float64
 	Point  Vec3
 	Normal Vec3
+	// UV holds the texture coordinates of the hit in X and Y, where the geometry has any
+	UV Vec3
+	// Material is the material of the surface hit, nil for geometry that only has a Color
+	Material *Material
+	// Mesh is the mesh hit, nil for other geometry, and Face the index of the face hit in it
+	Mesh *Mesh
+	Face int
+	// Transform places the mesh hit in the world through instances, nil when its faces are in world space
+	Transform *Transform
+	// DUVDX and DUVDY are how much UV changes to the next pixel across and down, zero when unknown
+	DUVDX, DUVDY Vec3
 }
 
 // HitInfo holds information regarding a hit
@@ -19,3 +30,24 @@ type HitInfo struct {
 func (h Hit) IsHit() bool {
 	return h.T < infinity
 }
+
+// triangle returns the face hit in world space, and false for hits on other geometry
+func (h Hit) triangle() (Triangle, bool) {
+	if h.Mesh == nil {
+		return Triangle{}, false
+	}
+	t := h.Mesh.triangle(h.Face)
+	if h.Transform != nil {
+		t = h.Transform.triangle(t)
+	}
+	return t, true
+}
+
+// vertexColor returns the vertex colors of the face hit interpolated at the hit
+func (h Hit) vertexColor() Vec3 {
+	p := h.Point
+	if h.Transform != nil {
+		p = h.Transform.toObject.MulPoint(p)
+	}
+	return h.Mesh.colorAt(h.Face, p)
+}
@@ -0,0 +1,110 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+// Transform is an object-to-world Matrix with the inverses that take rays into object space and
+// normals out of it
+type Transform struct {
+	toWorld, toObject, normals Matrix
+}
+
+// newTransform returns the Transform of the object-to-world matrix, which must be invertible
+func newTransform(matrix Matrix) *Transform {
+	inverse := matrix.Inverse()
+	return &Transform{matrix, inverse, inverse.Transpose()}
+}
+
+// then returns the transform applying t and then outer
+func (t *Transform) then(outer *Transform) *Transform {
+	return &Transform{outer.toWorld.Mul(t.toWorld), t.toObject.Mul(outer.toObject), outer.normals.Mul(t.normals)}
+}
+
+// triangle returns t moved from object to world space
+func (t *Transform) triangle(tri Triangle) Triangle {
+	tri.V1, tri.V2, tri.V3 = t.toWorld.MulPoint(tri.V1), t.toWorld.MulPoint(tri.V2), t.toWorld.MulPoint(tri.V3)
+	tri.N1, tri.N2, tri.N3 = t.normals.MulDirection(tri.N1), t.normals.MulDirection(tri.N2), t.normals.MulDirection(tri.N3)
+	return tri
+}
+
+// Instance places a Geometry in the scene through an object-to-world Matrix. Many instances can share
+// one Mesh, so copies of a model don't copy its triangles.
+type Instance struct {
+	Geometry Geometry
+	*Transform
+	// bounds is the world space bounding box of the geometry, nil when it's unbounded
+	bounds *Box
+}
+
+// newInstance returns an instance of geometry placed by the invertible object-to-world matrix. Rays are
+// intersected in object space, so a mirroring matrix culls the same side of a mesh as any other, just
+// as Mesh.Transform keeps mirrored faces facing the same way.
+func newInstance(geometry Geometry, matrix Matrix) *Instance {
+	in := &Instance{geometry, newTransform(matrix), nil}
+	if box, ok := geometryBounds(geometry); ok {
+		world := matrix.MulBox(box)
+		in.bounds = &world
+	}
+	return in
+}
+
+// geometryBounds returns the bounding box of the geometry, and false if it's unbounded
+func geometryBounds(geometry Geometry) (Box, bool) {
+	switch g := geometry.(type) {
+	case *Mesh:
+		return *g.kd.Box, true
+	case *Sphere:
+		r := Vec3{g.radius, g.radius, g.radius}
+		return Box{g.center.Sub(r), g.center.Add(r)}, true
+	case *Instance:
+		if g.bounds != nil {
+			return *g.bounds, true
+		}
+	}
+	return Box{}, false
+}
+
+// IntersectHit intersects the geometry with r taken into object space, returning the hit in world space
+func (in *Instance) IntersectHit(r Ray) Hit {
+	if in.bounds != nil {
+		if tmin, tmax := in.bounds.Intersect(r); tmax < tmin || tmax <= 0 {
+			return NoHit
+		}
+	}
+	hit := in.Geometry.IntersectHit(in.toObject.MulRay(r))
+	if !hit.IsHit() {
+		return NoHit
+	}
+	// Object space distances are scaled, the distance is measured again along the world ray
+	hit.Point = in.toWorld.MulPoint(hit.Point)
+	hit.T = dotProduct(hit.Point.Sub(r.Origin), r.Direction)
+	hit.Normal = in.normals.MulDirection(hit.Normal)
+	if hit.Mesh != nil {
+		if hit.Transform == nil {
+			hit.Transform = in.Transform
+		} else {
+			hit.Transform = hit.Transform.then(in.Transform)
+		}
+	}
+	return hit
+}
+
+// ColorAt returns the color of the geometry at a hit, which it sees in object space
+func (in *Instance) ColorAt(hit Hit) Vec3 {
+	hit.Point = in.toObject.MulPoint(hit.Point)
+	hit.Transform = nil
+	return in.Geometry.ColorAt(hit)
+}
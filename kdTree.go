@@ -19,7 +19,9 @@ package main
 
 import (
 	"math"
+	"runtime"
 	"sort"
+	"sync"
 )
 
 // Axis represents which axis we partition on
@@ -36,51 +38,111 @@ const (
 	AxisZ Axis = iota
 )
 
+const (
+	// kdLeafSize is the number of faces below which nodes aren't split
+	kdLeafSize = 8
+	// kdMaxShare is the largest share of the faces of a node either side of a split may hold
+	kdMaxShare = 0.85
+	// kdParallelSize is the number of faces from which the sorts and subtrees of a node are worth
+	// handing to other goroutines
+	kdParallelSize = 4096
+)
+
 // KdTree represents the root of a kd-Tree
 type KdTree struct {
 	Box  *Box
 	Root *Node
 }
 
-func buildTree(triangles []*Triangle) *KdTree {
+// faceHit is the nearest intersection of a ray with the faces of a mesh, T is infinity for none
+type faceHit struct {
+	T, U, V float64
+	Face    int
+}
+
+var noFaceHit = faceHit{infinity, 0, 0, 0}
+
+// buildTree builds the kd-tree of the faces of m
+func buildTree(m *Mesh) *KdTree {
+	return buildTreeWith(m, runtime.NumCPU()-1)
+}
+
+// buildTreeWith builds the kd-tree of the faces of m in up to workers goroutines besides the calling one
+func buildTreeWith(m *Mesh, workers int) *KdTree {
+	faces := make([]uint32, len(m.faces))
+	for i := range faces {
+		faces[i] = uint32(i)
+	}
 	// Ensure our bounding box contains all triangles
-	box := triangles[0].boundingBox()
-	for _, triangle := range triangles[1:] {
-		box.Expand(triangle.boundingBox())
+	box := m.faceBox(0)
+	for _, face := range faces[1:] {
+		box.Expand(m.faceBox(face))
 	}
-	node := newNode(triangles)
-	node.split(0)
+	node := newNode(faces)
+	b := &kdBuilder{m, make(chan struct{}, workers)}
+	node.split(b, 0)
 	return &KdTree{box, node}
 }
 
-// Intersect performs an intersection test on the kd-tree
-func (tree *KdTree) Intersect(r Ray) Hit {
+// kdBuilder splits the nodes of the kd-tree of m, in as many goroutines besides the calling one as
+// workers holds. Nodes are split the same way whichever goroutine splits them, so the tree is the
+// same as a serial build's.
+type kdBuilder struct {
+	m       *Mesh
+	workers chan struct{}
+}
+
+// parallel runs tasks for a node of size faces and waits for them. Tasks of large nodes are handed
+// to new goroutines while workers are free, the last one always runs in the calling goroutine.
+func (b *kdBuilder) parallel(size int, tasks ...func()) {
+	var done sync.WaitGroup
+	for i, task := range tasks {
+		if size >= kdParallelSize && i < len(tasks)-1 {
+			select {
+			case b.workers <- struct{}{}:
+				done.Add(1)
+				go func(task func()) {
+					defer done.Done()
+					task()
+					<-b.workers
+				}(task)
+				continue
+			default:
+			}
+		}
+		task()
+	}
+	done.Wait()
+}
+
+// Intersect performs an intersection test on the kd-tree of m
+func (tree *KdTree) Intersect(m *Mesh, r Ray) faceHit {
 	tmin, tmax := tree.Box.Intersect(r)
 	if tmax < tmin || tmax <= 0 {
-		return NoHit
+		return noFaceHit
 	}
-	return tree.Root.intersect(r, tmin, tmax)
+	return tree.Root.intersect(m, r, tmin, tmax)
 }
 
-// Node represents a node in a kd-tree
+// Node represents a node in a kd-tree, leaves hold the indices of their faces in the mesh
 type Node struct {
-	Axis      Axis
-	Point     float64
-	Triangles []*Triangle
-	Left      *Node
-	Right     *Node
+	Axis  Axis
+	Point float64
+	Faces []uint32
+	Left  *Node
+	Right *Node
 }
 
-func newNode(shapes []*Triangle) *Node {
-	return &Node{AxisNone, 0, shapes, nil, nil}
+func newNode(faces []uint32) *Node {
+	return &Node{AxisNone, 0, faces, nil, nil}
 }
 
-func (node *Node) intersect(r Ray, tmin, tmax float64) Hit {
+func (node *Node) intersect(m *Mesh, r Ray, tmin, tmax float64) faceHit {
 	var tsplit float64
 	var leftFirst bool
 	switch node.Axis {
 	case AxisNone:
-		return node.intersectTriangles(r)
+		return node.intersectFaces(m, r)
 	case AxisX:
 		tsplit = (node.Point - r.Origin.X) / r.Direction.X
 		leftFirst = (r.Origin.X < node.Point) || (r.Origin.X == node.Point && r.Direction.X <= 0)
@@ -100,15 +162,15 @@ func (node *Node) intersect(r Ray, tmin, tmax float64) Hit {
 		second = node.Left
 	}
 	if tsplit > tmax || tsplit <= 0 {
-		return first.intersect(r, tmin, tmax)
+		return first.intersect(m, r, tmin, tmax)
 	} else if tsplit < tmin {
-		return second.intersect(r, tmin, tmax)
+		return second.intersect(m, r, tmin, tmax)
 	} else {
-		h1 := first.intersect(r, tmin, tsplit)
+		h1 := first.intersect(m, r, tmin, tsplit)
 		if h1.T <= tsplit {
 			return h1
 		}
-		h2 := second.intersect(r, tsplit, math.Min(tmax, h1.T))
+		h2 := second.intersect(m, r, tsplit, math.Min(tmax, h1.T))
 		if h1.T <= h2.T {
 			return h1
 		}
@@ -116,21 +178,23 @@ func (node *Node) intersect(r Ray, tmin, tmax float64) Hit {
 	}
 }
 
-func (node *Node) intersectTriangles(r Ray) Hit {
-	hit := NoHit
-	for _, triangle := range node.Triangles {
-		_, h := triangle.IntersectHit(r)
-		if h.T < hit.T {
-			hit = h
+func (node *Node) intersectFaces(m *Mesh, r Ray) faceHit {
+	hit := noFaceHit
+	for _, face := range node.Faces {
+		f := &m.faces[face]
+		t, u, v, ok := intersectTriangle(r, m.positions[f.V[0]], m.positions[f.V[1]], m.positions[f.V[2]],
+			m.faceCulling(f))
+		if ok && t < hit.T {
+			hit = faceHit{t, u, v, int(face)}
 		}
 	}
 	return hit
 }
 
-func (node *Node) partitionScore(axis Axis, point float64) int {
+func (node *Node) partitionScore(m *Mesh, axis Axis, point float64) int {
 	left, right := 0, 0
-	for _, shape := range node.Triangles {
-		box := shape.boundingBox()
+	for _, face := range node.Faces {
+		box := m.faceBox(face)
 		l, r := box.Partition(axis, point)
 		if l {
 			left++
@@ -145,31 +209,40 @@ func (node *Node) partitionScore(axis Axis, point float64) int {
 	return right
 }
 
-func (node *Node) partition(size int, axis Axis, point float64) (left, right []*Triangle) {
-	left = make([]*Triangle, 0, size)
-	right = make([]*Triangle, 0, size)
-	for _, shape := range node.Triangles {
-		box := shape.boundingBox()
+func (node *Node) partition(m *Mesh, size int, axis Axis, point float64) (left, right []uint32) {
+	left = make([]uint32, 0, size)
+	right = make([]uint32, 0, size)
+	for _, face := range node.Faces {
+		box := m.faceBox(face)
 		l, r := box.Partition(axis, point)
 		if l {
-			left = append(left, shape)
+			left = append(left, face)
 		}
 		if r {
-			right = append(right, shape)
+			right = append(right, face)
 		}
 	}
 	return
 }
 
-func (node *Node) split(depth int) {
-	if len(node.Triangles) < 8 {
+// trim drops the spare capacity partition leaves in the faces of a leaf
+func (node *Node) trim() {
+	if cap(node.Faces) > len(node.Faces) {
+		node.Faces = append([]uint32(nil), node.Faces...)
+	}
+}
+
+func (node *Node) split(b *kdBuilder, depth int) {
+	m := b.m
+	if len(node.Faces) < kdLeafSize {
+		node.trim()
 		return
 	}
-	xs := make([]float64, 0, len(node.Triangles)*2)
-	ys := make([]float64, 0, len(node.Triangles)*2)
-	zs := make([]float64, 0, len(node.Triangles)*2)
-	for _, shape := range node.Triangles {
-		box := shape.boundingBox()
+	xs := make([]float64, 0, len(node.Faces)*2)
+	ys := make([]float64, 0, len(node.Faces)*2)
+	zs := make([]float64, 0, len(node.Faces)*2)
+	for _, face := range node.Faces {
+		box := m.faceBox(face)
 		xs = append(xs, box.min.X)
 		xs = append(xs, box.max.X)
 		ys = append(ys, box.min.Y)
@@ -177,40 +250,39 @@ func (node *Node) split(depth int) {
 		zs = append(zs, box.min.Z)
 		zs = append(zs, box.max.Z)
 	}
-	sort.Float64s(xs)
-	sort.Float64s(ys)
-	sort.Float64s(zs)
+	b.parallel(len(node.Faces), func() { sort.Float64s(xs) }, func() { sort.Float64s(ys) },
+		func() { sort.Float64s(zs) })
 	mx, my, mz := median(xs), median(ys), median(zs)
-	best := int(float64(len(node.Triangles)) * 0.85)
+	best := int(float64(len(node.Faces)) * kdMaxShare)
 	bestAxis := AxisNone
 	bestPoint := 0.0
-	sx := node.partitionScore(AxisX, mx)
+	sx := node.partitionScore(m, AxisX, mx)
 	if sx < best {
 		best = sx
 		bestAxis = AxisX
 		bestPoint = mx
 	}
-	sy := node.partitionScore(AxisY, my)
+	sy := node.partitionScore(m, AxisY, my)
 	if sy < best {
 		best = sy
 		bestAxis = AxisY
 		bestPoint = my
 	}
-	sz := node.partitionScore(AxisZ, mz)
+	sz := node.partitionScore(m, AxisZ, mz)
 	if sz < best {
 		best = sz
 		bestAxis = AxisZ
 		bestPoint = mz
 	}
 	if bestAxis == AxisNone {
+		node.trim()
 		return
 	}
-	l, r := node.partition(best, bestAxis, bestPoint)
+	l, r := node.partition(m, best, bestAxis, bestPoint)
 	node.Axis = bestAxis
 	node.Point = bestPoint
 	node.Left = newNode(l)
 	node.Right = newNode(r)
-	node.Left.split(depth + 1)
-	node.Right.split(depth + 1)
-	node.Triangles = nil
+	b.parallel(len(node.Faces), func() { node.Left.split(b, depth+1) }, func() { node.Right.split(b, depth+1) })
+	node.Faces = nil
 }
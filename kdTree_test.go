@@ -0,0 +1,75 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+// sameNodes returns a description of the first difference between the trees under a and b, or ""
+func sameNodes(a, b *Node, path string) string {
+	if (a == nil) != (b == nil) {
+		return fmt.Sprintf("%s: a leaf in one tree only", path)
+	}
+	if a == nil {
+		return ""
+	}
+	if a.Axis != b.Axis || a.Point != b.Point || fmt.Sprint(a.Faces) != fmt.Sprint(b.Faces) {
+		return fmt.Sprintf("%s: split %v at %v with faces %v, and %v at %v with faces %v", path,
+			a.Axis, a.Point, a.Faces, b.Axis, b.Point, b.Faces)
+	}
+	if d := sameNodes(a.Left, b.Left, path+"L"); d != "" {
+		return d
+	}
+	return sameNodes(a.Right, b.Right, path+"R")
+}
+
+// TestBuildTreeParallel checks that building with workers gives the same tree as building serially
+func TestBuildTreeParallel(t *testing.T) {
+	teapot, err := OpenOBJ("teapot.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The teapot is too small to be split in parallel, the sphere isn't
+	meshes := map[string]*Mesh{"teapot": teapot, "sphere": sphereMesh(100, 100)}
+	for name, m := range meshes {
+		serial, parallel := buildTreeWith(m, 0), buildTreeWith(m, 8)
+		if *serial.Box != *parallel.Box {
+			t.Errorf("%s: bounds %v and %v differ", name, *serial.Box, *parallel.Box)
+		}
+		if d := sameNodes(serial.Root, parallel.Root, "root "); d != "" {
+			t.Errorf("%s: %s", name, d)
+		}
+	}
+}
+
+// BenchmarkBuildTree builds the kd-tree of a sphere of about 80k triangles, serially and with a worker
+// for each other CPU
+func BenchmarkBuildTree(b *testing.B) {
+	m := sphereMesh(200, 200)
+	for name, workers := range map[string]int{"serial": 0, "parallel": runtime.NumCPU() - 1} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buildTreeWith(m, workers)
+			}
+		})
+	}
+}
@@ -19,12 +19,16 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"image"
 	"image/png"
 	"math"
+	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
-	"sync"
+	"time"
 
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
@@ -44,8 +48,6 @@ var backgroundColor = Vec3{0.1, 0.1, 0.1}
 
 ////////////////////////////
 
-var wg sync.WaitGroup
-
 // Ray represents a ray of light from the camera
 type Ray struct {
 	Origin, Direction Vec3
@@ -59,7 +61,8 @@ type BoundingVolume interface {
 // Geometry represents any geometry that we can run IntersectHit on
 type Geometry interface {
 	IntersectHit(r Ray) Hit
-	Color() Vec3
+	// ColorAt returns the color of the geometry at a hit
+	ColorAt(hit Hit) Vec3
 }
 
 type rect struct {
@@ -69,89 +72,208 @@ type rect struct {
 	bottom int
 }
 
-func determineChunkSize(max int) int {
-	if max%32 == 0 {
-		return 32
+func main() {
+	//defer profile.Start().Stop()
+	outputPath := flag.String("o", "img.png", "path of the output PNG")
+	scenePath := flag.String("scene", "", "path of a JSON scene description, the built-in teapot scene when empty")
+	spp := flag.Int("spp", 0, "samples per pixel, overriding the scene's, more than one is the target of a progressive render")
+	progressive := flag.Bool("progressive", false, "render in refinement passes of 1, 2, 4, ... samples per pixel")
+	maxTime := flag.Duration("time", 0, "time budget of a progressive render (e.g. 10m), 0 for none")
+	noise := flag.Float64("noise", 0, "noise estimate at which a progressive render stops, 0 for none")
+	passImages := flag.Bool("pass-images", false, "write the output after every progressive pass, not only when sent SIGUSR1")
+	adaptive := flag.Float64("adaptive", 0, "relative error below which pixels stop being sampled, implies -progressive")
+	heatmapPath := flag.String("heatmap", "", "path of a PNG visualising the samples taken per pixel")
+	checkpointPath := flag.String("checkpoint", "goray.checkpoint", "path of the checkpoint file")
+	checkpointEvery := flag.Duration("checkpoint-every", 0, "interval between checkpoints (e.g. 10m), 0 disables checkpointing")
+	resume := flag.Bool("resume", false, "continue the render saved in the checkpoint file")
+	serveAddr := flag.String("serve", "", "coordinate a distributed render, handing tiles to workers connecting on this address (e.g. :7000)")
+	connectAddr := flag.String("connect", "", "render tiles for the coordinator at this address instead of writing an image")
+	lease := flag.Duration("lease", 5*time.Minute, "time a distributed worker has to render a tile before it is reissued")
+	httpAddr := flag.String("http", "", "run as a render server taking jobs over HTTP on this address (e.g. :8080)")
+	runners := flag.Int("jobs", 2, "number of jobs a render server renders at once")
+	tileSize := flag.Int("tile", defaultTileSize, "width and height of the tiles handed to workers, in pixels")
+	var regions regionList
+	flag.Var(&regions, "region", "render only the pixels in left,top,right,bottom, may be repeated")
+	paste := flag.Bool("paste", false, "paste the rendered regions into the existing output image instead of leaving the rest transparent")
+	orderName := flag.String("order", string(OrderSpiral), "order tiles are rendered in: scanline, spiral (from the centre) or hilbert")
+	exportPath := flag.String("export-stl", "", "write the meshes of the scene to this binary STL file instead of rendering")
+	meshCacheDir := flag.String("mesh-cache", defaultMeshCacheDir(), "directory caching parsed meshes and their k-d trees, empty to disable")
+	flag.Parse()
+	order, err := ParseTileOrder(*orderName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-
-	for i := 30; i <= max; i++ {
-		if max%i == 0 {
-			return i
+	if *tileSize <= 0 {
+		fmt.Fprintln(os.Stderr, "tile size must be positive")
+		os.Exit(2)
+	}
+	if *httpAddr != "" {
+		fmt.Printf("Serving render jobs on %s\n", *httpAddr)
+		server := newRenderServer(runtime.NumCPU()*2, *runners, MeshCache{*meshCacheDir})
+		if err := http.ListenAndServe(*httpAddr, server); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
 	}
-
-	return -1
-}
-
-func main() {
-	//defer profile.Start().Stop()
-	// Image size
-	w, h := 1920, 1080
-	// define chunk size for rendering
-	xChunkSize := determineChunkSize(w)
-	yChunkSize := determineChunkSize(h)
+	desc := defaultScene()
+	dir := "."
+	if *scenePath != "" {
+		if desc, err = LoadSceneDescription(*scenePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		dir = filepath.Dir(*scenePath)
+	}
+	if *spp > 0 {
+		desc.Samples = *spp
+	}
 	// Create geometry for the scene
-	mesh, err := OpenOBJ("teapot.obj")
+	scene, camera, err := desc.Build(dir, MeshCache{*meshCacheDir}, false)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *exportPath != "" {
+		if err := exportSTL(*exportPath, scene); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
-
-	sp1 := &Sphere{center: Vec3{0, 0, 5}, radius: 1.0, color: Vec3{0, 0.7, 0}}
-	sp2 := &Sphere{center: Vec3{-2, -1.5, 3}, radius: 1.0, color: Vec3{0.1, 0.9, .7}}
-	sp3 := &Sphere{center: Vec3{-2, 1.5, 5}, radius: 1.0, color: Vec3{0.9, 0.9, .1}}
-	sp4 := &Sphere{center: Vec3{2, 1.5, 5}, radius: 1.0, color: Vec3{0.9, 0.1, .9}}
-	sp5 := &Sphere{center: Vec3{2, -1.5, 5}, radius: 1.0, color: Vec3{0.2, 0.4, .6}}
-
 	// Setup the renderer
-	light := Light{Vec3{-1.0, -2.0, 2.0}.Normalize(), 20}
-	scene := &Scene{light, []Geometry{mesh, sp1, sp2, sp3, sp4, sp5}}
-	eye := Vec3{0, 1, -2.0}
-	camera := Camera{}
-	camera.Init(eye, w, h)
-	jobChan := make(chan rect, 10)
-	imgChan := make(chan Pixel, w*h)
-	renderer := Renderer{scene, w, h, imgChan, &camera, jobChan}
+	w, h := desc.Width, desc.Height
+	renderer := newRenderer(scene, camera, w, h)
+	tiles := makeTiles(w, h, *tileSize, order)
+	var base *image.RGBA
+	if len(regions) > 0 {
+		if regions, err = clipRegions(regions, w, h); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		tiles = clipTiles(tiles, regions)
+		renderer.mask = regionMask(w, h, regions)
+		base = image.NewRGBA(image.Rect(0, 0, w, h))
+		if *paste {
+			if base, err = readBaseImage(*outputPath, w, h); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	}
+	// output returns the rendered image, pasted into the base image when rendering regions
+	output := func() image.Image {
+		img := renderer.CreateImage()
+		if base == nil {
+			return img
+		}
+		pasteRegions(base, img, regions)
+		return base
+	}
 	///////////////////
+	settings := renderSettings{w, h, tiles, regions, desc.Samples, *progressive || *adaptive > 0,
+		ProgressiveSettings{0, 0, *noise, *adaptive}}
+	if settings.Progressive {
+		// More than one sample per pixel is the target, otherwise stop at 256 when nothing else limits the render
+		if desc.Samples > 1 {
+			settings.Limits.TargetSamples = desc.Samples
+		} else if *maxTime == 0 && *noise == 0 {
+			settings.Limits.TargetSamples = 256
+		}
+	}
+	distributed := *serveAddr != "" || *connectAddr != ""
+	if distributed && settings.Progressive {
+		fmt.Fprintln(os.Stderr, "distributed renders can't be progressive")
+		os.Exit(2)
+	}
+	var hash []byte
+	if *resume || *checkpointEvery > 0 || distributed {
+		hash = renderHash(settings, camera, scene)
+	}
+	if *connectAddr != "" {
+		if err := renderer.RenderRemote(*connectAddr, tiles, hash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("No tiles left to render")
+		return
+	}
+	if *resume {
+		if err := renderer.LoadCheckpoint(*checkpointPath, hash); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Resuming from %s at pass %d\n", *checkpointPath, renderer.pass+1)
+	}
+	stopCheckpoints := func() {}
+	if *checkpointEvery > 0 {
+		stopCheckpoints = checkpointPeriodically(renderer, *checkpointPath, hash, *checkpointEvery)
+	}
 	fmt.Println("Rendering...")
-	bar := pb.StartNew((w / xChunkSize) * (h / yChunkSize))
-	// Create workers to render chunks
-	for i := 0; i < runtime.NumCPU()*2; i++ {
-		go renderer.worker(bar)
-	}
-	// Send chunks to workers
-	for y := 0; y < h; y += yChunkSize {
-		for x := 0; x < w; x += xChunkSize {
-			wg.Add(1)
-			renderer.jobChan <- rect{x, x + xChunkSize, y, y + yChunkSize}
+	if settings.Progressive {
+		snapshot := make(chan os.Signal, 1)
+		notifySnapshot(snapshot)
+		limits := settings.Limits
+		limits.TimeBudget = *maxTime
+		renderer.RenderProgressive(tiles, limits, func(pass, spp int, noise float64) {
+			select {
+			case <-snapshot:
+			default:
+				if !*passImages {
+					return
+				}
+			}
+			fmt.Printf("Writing pass %d to: %s\n", pass+1, *outputPath)
+			if err := writePNG(*outputPath, output()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		})
+	} else if renderer.pass == 0 && *serveAddr != "" {
+		if err := newCoordinator(renderer, tiles, desc.Samples, hash, *lease).Serve(*serveAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	} else if renderer.pass == 0 {
+		bar := pb.StartNew(len(tiles))
+		renderer.RenderPass(tiles, desc.Samples, 0, bar)
+		bar.FinishPrint("")
+	}
+	stopCheckpoints()
+	if *heatmapPath != "" {
+		if err := writePNG(*heatmapPath, renderer.fb.SampleHeatmap()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 		}
 	}
-	// Wait for all jobs to finish
-	wg.Wait()
-	close(renderer.pixelChan)
-	img := renderer.CreateImage()
-	bar.FinishPrint("")
-	outputPath := "img.png"
-	fmt.Printf("Writing output to: %s ...", outputPath)
+	img := output()
+	fmt.Printf("Writing output to: %s ...", *outputPath)
 	defer fmt.Println("Done")
-	outFile, err := os.Create(outputPath)
-	if err != nil {
+	if err := writePNG(*outputPath, img); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		return
 	}
-	// If an error occurs during write, print error to stderr
-	defer func() {
-		if err := outFile.Close(); err != nil {
+	// The render is safely on disk, the checkpoint is no longer needed
+	if *checkpointEvery > 0 || *resume {
+		if err := os.Remove(*checkpointPath); err != nil && !os.IsNotExist(err) {
 			fmt.Fprintln(os.Stderr, err)
 		}
-	}()
-	bufWriter := bufio.NewWriter(outFile)
-	// If an error occurs during write, print error to stderr
+	}
+}
+
+// writePNG encodes img as a PNG file at path
+func writePNG(path string, img image.Image) (err error) {
+	outFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// If an error occurs during close, report it unless the write already failed
 	defer func() {
-		if err := bufWriter.Flush(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		if cerr := outFile.Close(); err == nil {
+			err = cerr
 		}
 	}()
-	err = png.Encode(bufWriter, img)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	bufWriter := bufio.NewWriter(outFile)
+	if err := png.Encode(bufWriter, img); err != nil {
+		return err
 	}
+	return bufWriter.Flush()
 }
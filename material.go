@@ -0,0 +1,186 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"math"
+)
+
+// Material describes the appearance of a surface, following the Wavefront MTL model
+type Material struct {
+	Name string
+	// Ambient (Ka) is parsed but unused, the scene has no ambient light
+	Ambient Vec3
+	// Diffuse (Kd) is the diffuse reflectance
+	Diffuse Vec3
+	// Specular (Ks) is the specular reflectance, and the mirror reflectance when Illum asks for reflections
+	Specular Vec3
+	// Emission (Ke) is the light given off by the surface
+	Emission Vec3
+	// Shininess (Ns) is the specular exponent
+	Shininess float64
+	// IOR (Ni) is the index of refraction
+	IOR float64
+	// Opacity (d, or 1 - Tr) is 1 for opaque surfaces
+	Opacity float64
+	// Illum is the MTL illumination model
+	Illum int
+	// Maps holds the texture map statements by lower case keyword, e.g. "map_kd" or "map_bump"
+	Maps map[string]TextureMap
+	// DoubleSided makes faces with the material hit from both sides, whatever the culling of their mesh
+	DoubleSided bool
+}
+
+// TextureMap is a texture map statement of a material
+type TextureMap struct {
+	// Path is the image file, resolved against the directory of the MTL file
+	Path string
+	// Options holds the arguments of each option, e.g. "s" for -s 2 2 1
+	Options map[string][]string
+	// Scale and Offset (-s and -o) transform texture coordinates before the lookup
+	Scale, Offset Vec3
+	// Wrap is WrapClamp for -clamp on, otherwise WrapRepeat
+	Wrap WrapMode
+	// Bump is the -bm multiplier of the heights of a bump map
+	Bump float64
+	// Filter is how lookups are averaged over their footprint, FilterEWA unless a scene file says otherwise
+	Filter FilterMode
+	// Image is nil until the map is loaded, or if it couldn't be
+	Image *ImageTexture
+}
+
+// newMaterial returns a material with the MTL defaults
+func newMaterial(name string) *Material {
+	return &Material{Name: name, Diffuse: Vec3{0.8, 0.8, 0.8}, Shininess: 1, IOR: 1, Opacity: 1, Illum: 2,
+		Maps: make(map[string]TextureMap)}
+}
+
+// diffuseAt returns the diffuse reflectance at a hit, Kd modulated by map_Kd and the vertex colors
+func (m *Material) diffuseAt(hit Hit) Vec3 {
+	diffuse := m.Diffuse
+	if tm, ok := m.Maps["map_kd"]; ok && tm.Image != nil {
+		diffuse = diffuse.MulVec(tm.Lookup(hit))
+	}
+	if hit.Mesh != nil && hit.Mesh.colors != nil {
+		diffuse = diffuse.MulVec(hit.vertexColor())
+	}
+	return diffuse
+}
+
+// shadingNormal returns the normal at a hit after the map_norm normal map or, failing that, the
+// map_bump bump map. Hits on triangles without texture coordinates keep the interpolated normal.
+func (m *Material) shadingNormal(hit Hit) Vec3 {
+	t, ok := hit.triangle()
+	if !ok {
+		return hit.Normal
+	}
+	// dp/du and dp/dv, how the surface moves along the texture coordinates
+	dpdu, dpdv, ok := t.partials()
+	if !ok {
+		return hit.Normal
+	}
+	// The normal of a back hit is turned to face the ray. Detail is added on the front, the side the
+	// tangents go with, and turned the same way.
+	if dotProduct(hit.Normal, t.normalAt(hit.Point)) < 0 {
+		hit.Normal = hit.Normal.Mul(-1)
+		return m.detailNormal(hit, dpdu, dpdv).Mul(-1)
+	}
+	return m.detailNormal(hit, dpdu, dpdv)
+}
+
+// detailNormal returns the normal at a front hit after the normal or bump map, the surface moving by
+// dpdu and dpdv along the texture coordinates
+func (m *Material) detailNormal(hit Hit, dpdu, dpdv Vec3) Vec3 {
+	if tm, ok := m.Maps["map_norm"]; ok && tm.Image != nil {
+		// Texels hold the normal in the tangent frame, each axis mapped from [-1, 1] to [0, 1]
+		c := tm.Lookup(hit).Mul(2).Sub(Vec3{1, 1, 1})
+		tangent, bitangent := tangentFrame(hit.Normal, dpdu, dpdv)
+		return tangent.Mul(c.X).Add(bitangent.Mul(c.Y), hit.Normal.Mul(c.Z)).Normalize()
+	}
+	if tm, ok := m.Maps["map_bump"]; ok && tm.Image != nil {
+		return tm.bump(hit, dpdu, dpdv)
+	}
+	return hit.Normal
+}
+
+// tangentFrame returns t and b made perpendicular to n and to each other, keeping their handedness
+func tangentFrame(n, t, b Vec3) (Vec3, Vec3) {
+	t = t.Sub(n.Mul(dotProduct(n, t))).Normalize()
+	b = b.Sub(n.Mul(dotProduct(n, b)), t.Mul(dotProduct(t, b))).Normalize()
+	return t, b
+}
+
+// reflective reports whether the illumination model traces mirror reflections
+func (m *Material) reflective() bool {
+	return m.Illum >= 3 && m.Illum <= 7 && m.Specular != zeroVec
+}
+
+// shade returns the light leaving a surface with a material along ray
+func (s *Scene) shade(ray RayDifferential, hit Hit, depth int) Vec3 {
+	m := hit.Material
+	diffuse := m.diffuseAt(hit)
+	// Model 0 is a constant color
+	if m.Illum == 0 {
+		return diffuse.Add(m.Emission)
+	}
+	c := m.Emission
+	// Light is reflected about the normal after detail maps, but rays still leave along the surface normal
+	n := m.shadingNormal(hit)
+	light := s.light.direction.Mul(-1)
+	nl := dotProduct(n, light)
+	if nl > 0 && !s.occluded(Ray{hit.Point.Add(hit.Normal.Mul(EPSILON)), light}) {
+		// The same scale as the default shading, so materials and plain colors fit in one scene
+		irradiance := 0.18 * s.light.intensity * nl
+		c = c.Add(diffuse.Mul(irradiance / math.Pi))
+		if m.Illum >= 2 && m.Specular != zeroVec {
+			// Normalized Blinn-Phong
+			h := light.Sub(ray.Direction).Normalize()
+			spec := (m.Shininess + 8) / (8 * math.Pi) * math.Pow(math.Max(0, dotProduct(n, h)), m.Shininess)
+			c = c.Add(m.Specular.Mul(irradiance * spec))
+		}
+	}
+	if depth >= MAXDEPTH {
+		return c
+	}
+	if m.reflective() {
+		c = c.Add(m.Specular.MulVec(s.rayTrace(ray.reflect(hit, n), depth+1)))
+	}
+	if m.Opacity < 1 {
+		behind := s.rayTrace(ray.transmit(hit), depth+1)
+		c = c.Mul(m.Opacity).Add(behind.Mul(1 - m.Opacity))
+	}
+	return c
+}
+
+// occluded reports whether ray hits anything in the scene
+func (s *Scene) occluded(ray Ray) bool {
+	for _, object := range s.geometry {
+		if hit := object.IntersectHit(ray); hit.IsHit() {
+			return true
+		}
+	}
+	return false
+}
+
+// surfaceColor returns the diffuse color of a hit on object
+func surfaceColor(hit Hit, object Geometry) Vec3 {
+	if hit.Material != nil {
+		return hit.Material.diffuseAt(hit)
+	}
+	return object.ColorAt(hit)
+}
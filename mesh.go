@@ -1,6 +1,12 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 /*
    Copyright (C) 2016 Nathan Jaremko
@@ -19,29 +25,320 @@ import "fmt"
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
-// Mesh contains its respective triangles, and their bounding kd-tree
+// Mesh is a triangle mesh and its bounding kd-tree. Its faces index into positions, normals and
+// texture coordinates shared between them, so each vertex is stored once.
 type Mesh struct {
-	triangles []*Triangle
+	// positions, normals and uvs start with a zero placeholder, the index of corners without a
+	// normal or texture coordinates. Corners with a zero normal take the normal of their face.
+	positions, normals, uvs []Vec3
+	// colors holds a color for each position, nil for meshes without vertex colors
+	colors []Vec3
+	faces  []meshFace
+	// materials is indexed by the faces, materials[0] is nil for faces drawn in the mesh color
+	materials []*Material
 	kd        *KdTree
+	// groups names the runs of triangles read under each o, g and usemtl statement
+	groups []MeshGroup
+	// texture, when set, colors the triangles that have no material. It sees points in the coordinates
+	// of the mesh, those of its file after any baked transform. Instances pass it points in those
+	// coordinates too, so the texture moves with each copy.
+	texture Texture
+	// culling is the side of the faces rays miss, faces with a double-sided material are hit from both
+	culling Culling
+	// files lists the files besides its own the mesh was read from, such as MTL libraries, found or not
+	files []string
 }
 
-func newMesh(triangles []*Triangle) *Mesh {
+// meshFace is a triangle of a Mesh, the indices of its corners' position, normal and texture
+// coordinates, and of its material
+type meshFace struct {
+	V, N, T  [3]uint32
+	Material uint32
+}
+
+// MeshGroup is a run of consecutive triangles sharing an object, group and material
+type MeshGroup struct {
+	Object, Group string
+	// Material is nil for triangles drawn in the mesh color
+	Material     *Material
+	First, Count int
+}
+
+// newMesh returns an empty Mesh for a reader to fill before calling finish. Readers leave building the
+// kd-tree to OpenMesh, so meshes baked on loading are only built once.
+func newMesh() *Mesh {
+	return &Mesh{positions: make([]Vec3, 1), normals: make([]Vec3, 1), uvs: make([]Vec3, 1),
+		materials: make([]*Material, 1)}
+}
+
+// finish gives the positions added after the last colors white, and gives back the spare capacity the
+// reader left
+func (m *Mesh) finish() {
+	if m.colors != nil {
+		m.addColors(len(m.positions), nil)
+	}
+	// Readers grow the arrays as they go, their spare capacity is given back
+	m.positions, m.normals, m.uvs, m.colors = clipVectors(m.positions), clipVectors(m.normals), clipVectors(m.uvs),
+		clipVectors(m.colors)
+	if cap(m.faces) > len(m.faces) {
+		m.faces = append([]meshFace(nil), m.faces...)
+	}
+}
+
+// build finishes the mesh and builds the kd-tree of its faces
+func (m *Mesh) build() {
+	m.finish()
 	fmt.Printf("Building k-d tree... ")
-	kdTree := buildTree(triangles)
+	m.kd = buildTree(m)
 	fmt.Println("Done")
-	return &Mesh{triangles, kdTree}
 }
 
-// Color returns the color of the Mesh
-func (m Mesh) Color() Vec3 {
+// clipVectors returns v without spare capacity
+func clipVectors(v []Vec3) []Vec3 {
+	if cap(v) > len(v) {
+		return append([]Vec3(nil), v...)
+	}
+	return v
+}
+
+// addMaterial returns the index of material in the materials of the mesh, adding it if it's new
+func (m *Mesh) addMaterial(material *Material) uint32 {
+	for i, known := range m.materials {
+		if known == material {
+			return uint32(i)
+		}
+	}
+	m.materials = append(m.materials, material)
+	return uint32(len(m.materials) - 1)
+}
+
+// addColors gives the positions from first on colors, the positions before them white
+func (m *Mesh) addColors(first int, colors []Vec3) {
+	for len(m.colors) < first {
+		m.colors = append(m.colors, Vec3{1, 1, 1})
+	}
+	m.colors = append(m.colors[:first], colors...)
+}
+
+// triangle returns face i with its corners looked up. Corners without a normal get the normal of the face.
+func (m *Mesh) triangle(i int) Triangle {
+	f := &m.faces[i]
+	t := Triangle{
+		V1: m.positions[f.V[0]], V2: m.positions[f.V[1]], V3: m.positions[f.V[2]],
+		N1: m.normals[f.N[0]], N2: m.normals[f.N[1]], N3: m.normals[f.N[2]],
+		T1: m.uvs[f.T[0]], T2: m.uvs[f.T[1]], T3: m.uvs[f.T[2]],
+		material: m.materials[f.Material]}
+	t.fixNormals()
+	return t
+}
+
+// colorAt returns the vertex colors of face i interpolated at p
+func (m *Mesh) colorAt(i int, p Vec3) Vec3 {
+	f := &m.faces[i]
+	t := Triangle{V1: m.positions[f.V[0]], V2: m.positions[f.V[1]], V3: m.positions[f.V[2]]}
+	u, v, w := t.barycentric(p)
+	return m.colors[f.V[0]].Mul(u).Add(m.colors[f.V[1]].Mul(v), m.colors[f.V[2]].Mul(w))
+}
+
+// cornerAngle returns the angle of face i at its corner on position v
+func (m *Mesh) cornerAngle(i uint32, v uint32) float64 {
+	f := &m.faces[i]
+	j := 0
+	for f.V[j] != v {
+		j++
+	}
+	p := m.positions[v]
+	a := m.positions[f.V[(j+1)%3]].Sub(p).Normalize()
+	b := m.positions[f.V[(j+2)%3]].Sub(p).Normalize()
+	return math.Acos(clamp(dotProduct(a, b), -1, 1))
+}
+
+// faceCulling returns the culling of face f
+func (m *Mesh) faceCulling(f *meshFace) Culling {
+	if m.culling != CullNone && f.Material != 0 && m.materials[f.Material].DoubleSided {
+		return CullNone
+	}
+	return m.culling
+}
+
+// faceBox returns the bounding box of face i
+func (m *Mesh) faceBox(i uint32) *Box {
+	f := &m.faces[i]
+	box, err := computeBoundingBox([]Vec3{m.positions[f.V[0]], m.positions[f.V[1]], m.positions[f.V[2]]})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return box
+}
+
+// flip reverses the winding of face i
+func (f *meshFace) flip() {
+	f.V[1], f.V[2] = f.V[2], f.V[1]
+	f.N[1], f.N[2] = f.N[2], f.N[1]
+	f.T[1], f.T[2] = f.T[2], f.T[1]
+}
+
+// BakeOptions are transforms Bake applies to the vertices of a mesh, in the order of the fields
+type BakeOptions struct {
+	// Recentre moves the centre of the bounding box to the origin
+	Recentre bool
+	// Normalise scales the mesh about the origin so the longest side of its bounding box is 1
+	Normalise bool
+	// Matrix, when set, transforms the mesh like Transform
+	Matrix *Matrix
+	// FlipWinding turns the faces inside out
+	FlipWinding bool
+}
+
+// Bake applies options to the mesh, rebuilding its kd-tree, if it has one, when they change it
+func (m *Mesh) Bake(options BakeOptions) {
+	if options == (BakeOptions{}) {
+		return
+	}
+	if options.Recentre {
+		m.Recentre()
+	}
+	if options.Normalise {
+		m.Normalise()
+	}
+	if options.Matrix != nil {
+		m.Transform(*options.Matrix)
+	}
+	if options.FlipWinding {
+		m.FlipWinding()
+	}
+	if m.kd != nil {
+		m.Rebuild()
+	}
+}
+
+// Rebuild builds the kd-tree again, after the positions of the mesh have changed
+func (m *Mesh) Rebuild() {
+	m.build()
+}
+
+// Bounds returns the bounding box of the faces of the mesh, which may differ from the box of its
+// kd-tree until it's rebuilt
+func (m *Mesh) Bounds() Box {
+	box := Box{m.positions[m.faces[0].V[0]], m.positions[m.faces[0].V[0]]}
+	for _, f := range m.faces {
+		for _, v := range f.V {
+			box.min, box.max = box.min.Min(m.positions[v]), box.max.Max(m.positions[v])
+		}
+	}
+	return box
+}
+
+// Recentre moves the mesh so the centre of its bounding box is at the origin. The kd-tree isn't rebuilt.
+func (m *Mesh) Recentre() {
+	box := m.Bounds()
+	m.Transform(Translate(box.min.Add(box.max).Mul(-0.5)))
+}
+
+// Normalise scales the mesh uniformly about the origin so the longest side of its bounding box is 1.
+// Meshes without extent are left alone. The kd-tree isn't rebuilt.
+func (m *Mesh) Normalise() {
+	box := m.Bounds()
+	size := box.max.Sub(box.min)
+	longest := math.Max(size.X, math.Max(size.Y, size.Z))
+	if longest > 0 {
+		m.Transform(Scale(Vec3{1 / longest, 1 / longest, 1 / longest}))
+	}
+}
+
+// FlipWinding reverses the winding of the faces and the direction of the normals, turning the mesh
+// inside out. The kd-tree isn't rebuilt.
+func (m *Mesh) FlipWinding() {
+	for i := range m.faces {
+		m.faces[i].flip()
+	}
+	for i, n := range m.normals[1:] {
+		if n != zeroVec {
+			m.normals[i+1] = n.Mul(-1)
+		}
+	}
+}
+
+// Transform applies matrix to the positions of the mesh and its inverse transpose to the normals,
+// reversing the winding of the faces if it mirrors them so they keep facing the same way. The
+// kd-tree isn't rebuilt.
+func (m *Mesh) Transform(matrix Matrix) {
+	normals := matrix.Inverse().Transpose()
+	for i, p := range m.positions[1:] {
+		m.positions[i+1] = matrix.MulPoint(p)
+	}
+	for i, n := range m.normals[1:] {
+		if n != zeroVec {
+			m.normals[i+1] = normals.MulDirection(n)
+		}
+	}
+	if matrix.Determinant() < 0 {
+		for i := range m.faces {
+			m.faces[i].flip()
+		}
+	}
+}
+
+// OpenMesh reads a mesh file, picking the reader by extension: .ply, .stl and .3ds files are read by
+// OpenPLY, OpenSTL and Open3DS, anything else as OBJ with options. Confined applies to 3DS files too.
+// It builds the kd-tree the readers leave out.
+func OpenMesh(path string, options OBJOptions) (*Mesh, error) {
+	m, err := readMesh(path, options)
+	if err != nil {
+		return nil, err
+	}
+	m.build()
+	return m, nil
+}
+
+// readMesh reads a mesh file like OpenMesh, without building its kd-tree
+func readMesh(path string, options OBJOptions) (*Mesh, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ply":
+		return OpenPLY(path)
+	case ".stl":
+		return OpenSTL(path)
+	case ".3ds":
+		return open3DS(path, options.Confined)
+	}
+	return OpenOBJWith(path, options)
+}
+
+// Color returns the color of the triangles of the Mesh that have no material
+func (m *Mesh) Color() Vec3 {
 	return Vec3{0.1, 0.7, 0.9}
 }
 
+// ColorAt returns the color of a hit on a triangle without a material. A texture takes precedence
+// over the colors of the triangle's vertices, which take precedence over the mesh color.
+func (m *Mesh) ColorAt(hit Hit) Vec3 {
+	if m.texture == nil {
+		if hit.Mesh != nil && hit.Mesh.colors != nil {
+			return hit.vertexColor()
+		}
+		return m.Color()
+	}
+	// Image textures are filtered over the footprint of the hit
+	if tm, ok := m.texture.(TextureMap); ok && tm.Image != nil {
+		return tm.Lookup(hit)
+	}
+	return m.texture.At(hit.Point, hit.UV)
+}
+
 // IntersectHit performs an intersection test on a Mesh
-func (m Mesh) IntersectHit(r Ray) Hit {
-	hit := m.kd.Intersect(r)
-	if hit.IsHit() {
-		return hit
+func (m *Mesh) IntersectHit(r Ray) Hit {
+	h := m.kd.Intersect(m, r)
+	if h.T == infinity {
+		return NoHit
+	}
+	t := m.triangle(h.Face)
+	hitPoint := r.Origin.Add(r.Direction.Mul(h.T))
+	// u and v weight the texture coordinates of V2 and V3
+	uv := t.T1.Mul(1-h.U-h.V).Add(t.T2.Mul(h.U), t.T3.Mul(h.V))
+	n := t.normalAt(hitPoint)
+	// The back of a face is shaded with the normal turned to face the ray
+	if dotProduct(crossProduct(t.V2.Sub(t.V1), t.V3.Sub(t.V1)), r.Direction) > 0 {
+		n = n.Mul(-1)
 	}
-	return NoHit
+	return Hit{h.T, hitPoint, n, uv, t.material, m, h.Face, nil, zeroVec, zeroVec}
 }
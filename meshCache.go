@@ -0,0 +1,540 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// meshCacheVersion is bumped whenever the layout of cache files, or the meshes the readers and the
+// kd-tree build produce, change
+const meshCacheVersion = 5
+
+// meshCacheMagic starts every cache file
+var meshCacheMagic = []byte("goraymsh")
+
+// maxCachedTreeDepth bounds the kd-tree read from a cache file. Every split leaves at most kdMaxShare
+// of the faces on each side, so real trees are far shallower.
+const maxCachedTreeDepth = 256
+
+// MeshCache keeps the meshes read from files, with their kd-trees, in binary files in Dir, so later
+// runs skip parsing and building the tree. Cache files are named by a hash of the source file, its
+// reader and the build parameters, and check the MTL libraries the mesh used haven't changed.
+// A MeshCache without a Dir caches nothing.
+type MeshCache struct {
+	Dir string
+}
+
+// defaultMeshCacheDir returns the goray directory of the user's cache directory, or "" if there's none
+func defaultMeshCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "goray")
+}
+
+// meshCacheTable is the CRC-32 polynomial of the checksum ending cache files
+var meshCacheTable = crc32.MakeTable(crc32.Castagnoli)
+
+// meshCacheHeader is the gob encoded part of a cache file, before the arrays of the mesh and its tree
+type meshCacheHeader struct {
+	Files []cachedFile
+	// Materials holds the materials of the mesh after the nil one, without their images
+	Materials []Material
+	Groups    []cachedGroup
+	// The lengths of the arrays that follow
+	Positions, Normals, UVs, Colors, Faces, Nodes, Refs int
+}
+
+// cachedFile is a file the mesh was read from besides its own, and its hash, nil if it didn't exist.
+// Path is relative to the directory of the mesh file when it can be, so copies of a model share a cache
+// file wherever they are.
+type cachedFile struct {
+	Path string
+	Hash []byte
+}
+
+// cachedGroup is a MeshGroup with its material given by index into the materials of the mesh
+type cachedGroup struct {
+	Object, Group          string
+	Material, First, Count int
+}
+
+// Open reads the mesh at path like OpenMesh and bakes it, from the cache when it holds it, caching it
+// otherwise. A cache that can't be read or written is reported and bypassed.
+func (c MeshCache) Open(path string, options OBJOptions, bake BakeOptions) (*Mesh, error) {
+	if c.Dir == "" {
+		return openBaked(path, options, bake)
+	}
+	key, err := meshCacheKey(path, options, bake)
+	if err != nil {
+		return nil, err
+	}
+	cachePath := filepath.Join(c.Dir, hex.EncodeToString(key)+".mesh")
+	m, err := readMeshCache(cachePath, key, filepath.Dir(path))
+	if err == nil {
+		return m, nil
+	}
+	if !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if m, err = openBaked(path, options, bake); err != nil {
+		return nil, err
+	}
+	if err := writeMeshCache(cachePath, key, filepath.Dir(path), m); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return m, nil
+}
+
+// openBaked reads the mesh at path like OpenMesh, and bakes it before building its kd-tree
+func openBaked(path string, options OBJOptions, bake BakeOptions) (*Mesh, error) {
+	m, err := readMesh(path, options)
+	if err != nil {
+		return nil, err
+	}
+	m.Bake(bake)
+	m.build()
+	return m, nil
+}
+
+// meshCacheKey hashes the contents of the file at path with everything else that shapes its mesh
+func meshCacheKey(path string, options OBJOptions, bake BakeOptions) ([]byte, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "goray mesh %d\n%q\n%#v\n%d %g\n", meshCacheVersion, strings.ToLower(filepath.Ext(path)), options,
+		kdLeafSize, kdMaxShare)
+	fmt.Fprintf(h, "bake %t %t %t\n", bake.Recentre, bake.Normalise, bake.FlipWinding)
+	if bake.Matrix != nil {
+		fmt.Fprintf(h, "%#v\n", *bake.Matrix)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	if _, err := io.Copy(h, file); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// hashFile returns the SHA-256 of the file at path, nil if it doesn't exist
+func hashFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// writeMeshCache writes m, read from a file in dir, to path. The file is written under a temporary name
+// and renamed, so readers, even in other processes, never see half of it.
+func writeMeshCache(path string, key []byte, dir string, m *Mesh) error {
+	header := meshCacheHeader{Positions: len(m.positions), Normals: len(m.normals), UVs: len(m.uvs),
+		Colors: len(m.colors), Faces: len(m.faces)}
+	for _, f := range m.files {
+		hash, err := hashFile(f)
+		if err != nil {
+			return err
+		}
+		header.Files = append(header.Files, cachedFile{relativePath(dir, f), hash})
+	}
+	index := make(map[*Material]int)
+	for i, material := range m.materials[1:] {
+		plain := *material
+		plain.Maps = make(map[string]TextureMap)
+		for keyword, tm := range material.Maps {
+			tm.Path, tm.Image = relativePath(dir, tm.Path), nil
+			plain.Maps[keyword] = tm
+		}
+		header.Materials = append(header.Materials, plain)
+		index[material] = i + 1
+	}
+	for _, g := range m.groups {
+		header.Groups = append(header.Groups, cachedGroup{g.Object, g.Group, index[g.Material], g.First, g.Count})
+	}
+	m.kd.Root.count(&header.Nodes, &header.Refs)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Temporary files are private, the cache is as readable as the files the meshes were read from
+	if err := file.Chmod(0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// The file ends with a checksum of everything before it
+	crc := crc32.New(meshCacheTable)
+	w := bufio.NewWriterSize(io.MultiWriter(file, crc), 1<<16)
+	w.Write(meshCacheMagic)
+	binary.Write(w, binary.LittleEndian, uint32(meshCacheVersion))
+	w.Write(key)
+	err = gob.NewEncoder(w).Encode(&header)
+	if err == nil {
+		for _, vectors := range [][]Vec3{m.positions, m.normals, m.uvs, m.colors} {
+			writeVectors(w, vectors...)
+		}
+		var buf [40]byte
+		for _, f := range m.faces {
+			for i, v := range [10]uint32{f.V[0], f.V[1], f.V[2], f.N[0], f.N[1], f.N[2], f.T[0], f.T[1], f.T[2],
+				f.Material} {
+				binary.LittleEndian.PutUint32(buf[4*i:], v)
+			}
+			w.Write(buf[:])
+		}
+		writeVectors(w, m.kd.Box.min, m.kd.Box.max)
+		m.kd.Root.write(w)
+		if err = w.Flush(); err == nil {
+			err = binary.Write(file, binary.LittleEndian, crc.Sum32())
+		}
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("caching mesh: %v", err)
+	}
+	return nil
+}
+
+// count adds the nodes of the tree under node to nodes, and the face indices of its leaves to refs
+func (node *Node) count(nodes, refs *int) {
+	*nodes++
+	if node.Axis == AxisNone {
+		*refs += len(node.Faces)
+		return
+	}
+	node.Left.count(nodes, refs)
+	node.Right.count(nodes, refs)
+}
+
+// write writes the tree under node depth first: the axis and split point of each node, then the
+// face count and indices of leaves or the left and right subtrees of splits
+func (node *Node) write(w *bufio.Writer) {
+	var buf [9]byte
+	buf[0] = byte(node.Axis)
+	binary.LittleEndian.PutUint64(buf[1:], math.Float64bits(node.Point))
+	w.Write(buf[:])
+	if node.Axis != AxisNone {
+		node.Left.write(w)
+		node.Right.write(w)
+		return
+	}
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(node.Faces)))
+	w.Write(buf[:4])
+	for _, face := range node.Faces {
+		binary.LittleEndian.PutUint32(buf[:], face)
+		w.Write(buf[:4])
+	}
+}
+
+// errCorruptCache reports a cache file whose contents don't add up
+var errCorruptCache = errors.New("cache file is corrupt")
+
+// readMeshCache reads the mesh cached at path for a file in dir, failing if it was cached under another
+// key or the files it was read from have changed
+func readMeshCache(path string, key []byte, dir string) (*Mesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size() - 4
+	if size < 0 {
+		return nil, fmt.Errorf("%s: %v", path, errCorruptCache)
+	}
+	crc := crc32.New(meshCacheTable)
+	r := bufio.NewReaderSize(io.TeeReader(io.LimitReader(file, size), crc), 1<<16)
+	prefix := make([]byte, len(meshCacheMagic)+4+len(key))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, errCorruptCache)
+	}
+	version := binary.LittleEndian.Uint32(prefix[len(meshCacheMagic):])
+	switch {
+	case !bytes.Equal(prefix[:len(meshCacheMagic)], meshCacheMagic):
+		return nil, fmt.Errorf("%s: not a mesh cache file", path)
+	case version != meshCacheVersion:
+		return nil, fmt.Errorf("%s: mesh cache version %d, expected %d", path, version, meshCacheVersion)
+	case !bytes.Equal(prefix[len(prefix)-len(key):], key):
+		return nil, fmt.Errorf("%s: mesh cache is for another file", path)
+	}
+	var header meshCacheHeader
+	// A bufio.Reader is a ByteReader, so the decoder reads no further than the header
+	if err := gob.NewDecoder(r).Decode(&header); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	var files []string
+	for _, f := range header.Files {
+		file := resolvePath(dir, f.Path)
+		hash, err := hashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(hash, f.Hash) {
+			return nil, fmt.Errorf("%s: %s changed since the mesh was cached", path, file)
+		}
+		files = append(files, file)
+	}
+	if !header.fits(size) {
+		return nil, fmt.Errorf("%s: %v", path, errCorruptCache)
+	}
+
+	fmt.Printf("Reading cached mesh and k-d tree... ")
+	m, err := header.read(r)
+	if err == nil {
+		err = checkMeshCacheEnd(file, r, size, crc.Sum32())
+	}
+	if err != nil {
+		fmt.Println("Failed")
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	fmt.Println("Done")
+	m.files = files
+	textures := make(map[textureKey]*ImageTexture)
+	for _, material := range m.materials[1:] {
+		for keyword, tm := range material.Maps {
+			tm.Path = resolvePath(dir, tm.Path)
+			material.Maps[keyword] = tm
+		}
+		material.loadMaps(textures)
+	}
+	return m, nil
+}
+
+// checkMeshCacheEnd checks r, reading file up to size, has been read to its end, and sum matches the
+// checksum after it
+func checkMeshCacheEnd(file *os.File, r *bufio.Reader, size int64, sum uint32) error {
+	if _, err := r.ReadByte(); err != io.EOF {
+		return errCorruptCache
+	}
+	var buf [4]byte
+	if _, err := file.ReadAt(buf[:], size); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(buf[:]) != sum {
+		return errCorruptCache
+	}
+	return nil
+}
+
+// relativePath returns path relative to dir when it can be, with forward slashes
+func relativePath(dir, path string) string {
+	if rel, err := filepath.Rel(dir, path); err == nil {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+// resolvePath returns a path written by relativePath resolved against dir
+func resolvePath(dir, path string) string {
+	path = filepath.FromSlash(path)
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// fits reports whether the arrays the header announces fit in a file of size bytes, so a corrupt
+// header can't ask for more memory than the file could fill
+func (header *meshCacheHeader) fits(size int64) bool {
+	counts := []int{header.Positions, header.Normals, header.UVs, header.Colors, header.Faces, header.Nodes,
+		header.Refs}
+	for _, n := range counts {
+		if n < 0 || int64(n) > size {
+			return false
+		}
+	}
+	vectors := int64(header.Positions + header.Normals + header.UVs + header.Colors)
+	return 24*vectors+40*int64(header.Faces)+9*int64(header.Nodes)+4*int64(header.Refs) <= size
+}
+
+// read reads the arrays that follow the header into a Mesh
+func (header *meshCacheHeader) read(r *bufio.Reader) (*Mesh, error) {
+	m := &Mesh{}
+	var err error
+	for _, a := range []struct {
+		vectors *[]Vec3
+		n       int
+	}{{&m.positions, header.Positions}, {&m.normals, header.Normals}, {&m.uvs, header.UVs}, {&m.colors, header.Colors}} {
+		if *a.vectors, err = readVectors(r, a.n); err != nil {
+			return nil, err
+		}
+	}
+	if header.Faces == 0 || len(m.positions) == 0 || len(m.normals) == 0 || len(m.uvs) == 0 ||
+		(m.colors != nil && len(m.colors) != len(m.positions)) {
+		return nil, errCorruptCache
+	}
+	m.materials = make([]*Material, 1, 1+len(header.Materials))
+	for i := range header.Materials {
+		material := &header.Materials[i]
+		if material.Maps == nil {
+			material.Maps = make(map[string]TextureMap)
+		}
+		m.materials = append(m.materials, material)
+	}
+	m.faces = make([]meshFace, header.Faces)
+	var buf [40]byte
+	for i := range m.faces {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		var v [10]uint32
+		for j := range v {
+			v[j] = binary.LittleEndian.Uint32(buf[4*j:])
+		}
+		f := meshFace{[3]uint32{v[0], v[1], v[2]}, [3]uint32{v[3], v[4], v[5]}, [3]uint32{v[6], v[7], v[8]}, v[9]}
+		for j := 0; j < 3; j++ {
+			if int(f.V[j]) >= len(m.positions) || int(f.N[j]) >= len(m.normals) || int(f.T[j]) >= len(m.uvs) {
+				return nil, errCorruptCache
+			}
+		}
+		if int(f.Material) >= len(m.materials) {
+			return nil, errCorruptCache
+		}
+		m.faces[i] = f
+	}
+	for _, g := range header.Groups {
+		if g.Material < 0 || g.Material >= len(m.materials) || g.First < 0 || g.Count < 0 ||
+			g.First+g.Count > len(m.faces) {
+			return nil, errCorruptCache
+		}
+		m.groups = append(m.groups, MeshGroup{g.Object, g.Group, m.materials[g.Material], g.First, g.Count})
+	}
+	box, err := readVectors(r, 2)
+	if err != nil {
+		return nil, err
+	}
+	// The nodes and the faces of the leaves are each read into one array
+	t := treeReader{r: r, faces: len(m.faces), nodes: make([]Node, header.Nodes), refs: make([]uint32, header.Refs)}
+	root, err := t.node(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.nodes) != 0 || len(t.refs) != 0 {
+		return nil, errCorruptCache
+	}
+	m.kd = &KdTree{&Box{box[0], box[1]}, root}
+	return m, nil
+}
+
+// treeReader reads the nodes written by Node.write into the nodes and refs left
+type treeReader struct {
+	r     *bufio.Reader
+	faces int
+	nodes []Node
+	refs  []uint32
+}
+
+func (t *treeReader) node(depth int) (*Node, error) {
+	if len(t.nodes) == 0 || depth > maxCachedTreeDepth {
+		return nil, errCorruptCache
+	}
+	node := &t.nodes[0]
+	t.nodes = t.nodes[1:]
+	var buf [9]byte
+	if _, err := io.ReadFull(t.r, buf[:]); err != nil {
+		return nil, err
+	}
+	node.Axis = Axis(buf[0])
+	node.Point = math.Float64frombits(binary.LittleEndian.Uint64(buf[1:]))
+	switch node.Axis {
+	case AxisNone:
+		if _, err := io.ReadFull(t.r, buf[:4]); err != nil {
+			return nil, err
+		}
+		n := int(binary.LittleEndian.Uint32(buf[:]))
+		if n > len(t.refs) {
+			return nil, errCorruptCache
+		}
+		node.Faces, t.refs = t.refs[:n:n], t.refs[n:]
+		for i := range node.Faces {
+			if _, err := io.ReadFull(t.r, buf[:4]); err != nil {
+				return nil, err
+			}
+			node.Faces[i] = binary.LittleEndian.Uint32(buf[:])
+			if int(node.Faces[i]) >= t.faces {
+				return nil, errCorruptCache
+			}
+		}
+	case AxisX, AxisY, AxisZ:
+		var err error
+		if node.Left, err = t.node(depth + 1); err != nil {
+			return nil, err
+		}
+		if node.Right, err = t.node(depth + 1); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errCorruptCache
+	}
+	return node, nil
+}
+
+// readVectors reads n vectors written by writeVectors
+func readVectors(r *bufio.Reader, n int) ([]Vec3, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	vectors := make([]Vec3, n)
+	var buf [24]byte
+	for i := range vectors {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		vectors[i] = Vec3{math.Float64frombits(binary.LittleEndian.Uint64(buf[0:])),
+			math.Float64frombits(binary.LittleEndian.Uint64(buf[8:])),
+			math.Float64frombits(binary.LittleEndian.Uint64(buf[16:]))}
+	}
+	return vectors, nil
+}
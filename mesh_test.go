@@ -0,0 +1,167 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// sphereMesh returns a unit sphere of rings by segments quads, split into triangles, with smooth
+// normals and texture coordinates following latitude and longitude
+func sphereMesh(rings, segments int) *Mesh {
+	m := newMesh()
+	for i := 0; i <= rings; i++ {
+		theta := math.Pi * float64(i) / float64(rings)
+		for j := 0; j <= segments; j++ {
+			phi := 2 * math.Pi * float64(j) / float64(segments)
+			p := Vec3{math.Sin(theta) * math.Cos(phi), math.Cos(theta), math.Sin(theta) * math.Sin(phi)}
+			m.positions = append(m.positions, p)
+			m.normals = append(m.normals, p)
+			m.uvs = append(m.uvs, Vec3{float64(j) / float64(segments), float64(i) / float64(rings), 0})
+		}
+	}
+	// Vertices start at 1, after the placeholder
+	vertex := func(i, j int) uint32 { return uint32(1 + i*(segments+1) + j) }
+	for i := 0; i < rings; i++ {
+		for j := 0; j < segments; j++ {
+			a, b, c, d := vertex(i, j), vertex(i, j+1), vertex(i+1, j+1), vertex(i+1, j)
+			// Quads touching a pole are triangles, a and b or c and d being the pole
+			if i > 0 {
+				m.faces = append(m.faces, meshFace{V: [3]uint32{a, b, c}, N: [3]uint32{a, b, c}, T: [3]uint32{a, b, c}})
+			}
+			if i < rings-1 {
+				m.faces = append(m.faces, meshFace{V: [3]uint32{a, c, d}, N: [3]uint32{a, c, d}, T: [3]uint32{a, c, d}})
+			}
+		}
+	}
+	m.build()
+	return m
+}
+
+// randomRays returns n rays from points on a sphere of the given radius towards points in box
+func randomRays(rng *rand.Rand, n int, radius float64, box Box) []Ray {
+	rays := make([]Ray, n)
+	size := box.max.Sub(box.min)
+	for i := range rays {
+		origin := Vec3{rng.NormFloat64(), rng.NormFloat64(), rng.NormFloat64()}.Normalize().Mul(radius)
+		target := box.min.Add(Vec3{rng.Float64() * size.X, rng.Float64() * size.Y, rng.Float64() * size.Z})
+		rays[i] = Ray{origin, target.Sub(origin).Normalize()}
+	}
+	return rays
+}
+
+// triangleHit intersects r with every face of m looked up as a Triangle, as meshes did when they held a
+// Triangle per face, and shades the nearest hit from the Triangle's own corners
+func triangleHit(m *Mesh, r Ray) Hit {
+	nearest, best, bestU, bestV := -1, infinity, 0.0, 0.0
+	var triangle Triangle
+	for i := range m.faces {
+		t := m.triangle(i)
+		if d, u, v, ok := intersectTriangle(r, t.V1, t.V2, t.V3, m.faceCulling(&m.faces[i])); ok && d < best {
+			nearest, best, bestU, bestV, triangle = i, d, u, v, t
+		}
+	}
+	if nearest < 0 {
+		return NoHit
+	}
+	p := r.Origin.Add(r.Direction.Mul(best))
+	n := triangle.normalAt(p)
+	if dotProduct(triangle.computeNormal(), r.Direction) > 0 {
+		n = n.Mul(-1)
+	}
+	uv := triangle.T1.Mul(1-bestU-bestV).Add(triangle.T2.Mul(bestU), triangle.T3.Mul(bestV))
+	return Hit{T: best, Point: p, Normal: n, UV: uv, Face: nearest}
+}
+
+// TestMeshIntersectMatchesTriangles checks that the kd-tree of the teapot, reading its corners through
+// the shared arrays, finds the same hits as testing each face as a Triangle
+func TestMeshIntersectMatchesTriangles(t *testing.T) {
+	m, err := OpenMesh("teapot.obj", OBJOptions{CreaseAngle: defaultCreaseAngle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The teapot has no texture coordinates, so each vertex is given its position's
+	for i, p := range m.positions {
+		if i > 0 {
+			m.uvs = append(m.uvs, Vec3{p.X, p.Y, 0})
+		}
+	}
+	for i := range m.faces {
+		m.faces[i].T = m.faces[i].V
+	}
+	bounds := m.Bounds()
+	radius := bounds.max.Sub(bounds.min).Magnitude()
+	hits := 0
+	for i, r := range randomRays(rand.New(rand.NewSource(1)), 2000, radius, bounds) {
+		got, want := m.IntersectHit(r), triangleHit(m, r)
+		if (got.T == infinity) != (want.T == infinity) {
+			t.Fatalf("ray %d: mesh hit at %v, triangles at %v", i, got.T, want.T)
+		}
+		if want.T == infinity {
+			continue
+		}
+		hits++
+		// Rays through an edge may hit either face, whose normals and coordinates agree there
+		const tolerance = 1e-9
+		if got.T != want.T || got.Normal.Distance(want.Normal) > tolerance || got.UV.Distance(want.UV) > tolerance {
+			t.Fatalf("ray %d: mesh hit face %d at %v, normal %v, uv %v; triangles hit face %d at %v, normal %v, uv %v",
+				i, got.Face, got.T, got.Normal, got.UV, want.Face, want.T, want.Normal, want.UV)
+		}
+	}
+	if hits < 500 {
+		t.Fatalf("only %d of 2000 rays hit the teapot", hits)
+	}
+}
+
+// BenchmarkMeshIntersect traces rays at a sphere of about 80k triangles
+func BenchmarkMeshIntersect(b *testing.B) {
+	m := sphereMesh(200, 200)
+	rays := randomRays(rand.New(rand.NewSource(1)), 1<<16, 3, m.Bounds())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IntersectHit(rays[i%len(rays)])
+	}
+}
+
+// TestMirroredInstanceCulling checks that an instance mirroring a culled mesh culls the same side of the
+// mesh as one that doesn't, as a mirroring transform baked into the mesh does. The sphere is symmetric, so
+// both instances are hit at the same distance.
+func TestMirroredInstanceCulling(t *testing.T) {
+	for _, culling := range []Culling{CullBack, CullFront} {
+		m := sphereMesh(16, 32)
+		m.culling = culling
+		plain := newInstance(m, Translate(Vec3{0, 0, 5}))
+		mirrored := newInstance(m, Translate(Vec3{0, 0, 5}).Scale(Vec3{-1, 1, 1}))
+		baked := sphereMesh(16, 32)
+		baked.culling = culling
+		baked.Bake(BakeOptions{Matrix: &mirrored.toWorld})
+		r := Ray{Origin: Vec3{0.2, 0.1, 0}, Direction: Vec3{0, 0, 1}}
+		want := plain.IntersectHit(r)
+		if !want.IsHit() {
+			t.Fatalf("culling %d: ray missed the sphere", culling)
+		}
+		for name, g := range map[string]Geometry{"mirrored instance": mirrored, "baked mirror": baked} {
+			if got := g.IntersectHit(r); math.Abs(got.T-want.T) > 1e-9 {
+				t.Errorf("culling %d: %s hit at %v, want %v", culling, name, got.T, want.T)
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// mapOptionArgs is the number of arguments each texture map option takes, -o, -s and -t take up to three
+var mapOptionArgs = map[string]int{
+	"blendu": 1, "blendv": 1, "bm": 1, "boost": 1, "cc": 1, "clamp": 1, "imfchan": 1,
+	"mm": 2, "o": 3, "s": 3, "t": 3, "texres": 1, "type": 1,
+}
+
+// OpenMTL reads the materials of an MTL file, keyed by name, with the options of the OBJ file naming it.
+// Strict makes a malformed statement an error, otherwise it is reported on stderr and skipped, like in
+// OBJ files. Confined keeps texture maps inside the directory of the MTL file.
+func OpenMTL(path string, options OBJOptions) (map[string]*Material, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	dir := filepath.Dir(path)
+	materials := make(map[string]*Material)
+	var m *Material
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+		args := fields[1:]
+		if keyword == "newmtl" {
+			name := strings.Join(args, " ")
+			m = newMaterial(name)
+			materials[name] = m
+			continue
+		}
+		var err error
+		if m == nil {
+			err = fmt.Errorf("%s before newmtl", fields[0])
+		} else {
+			err = m.parseStatement(keyword, args, dir, options.Confined)
+		}
+		if err != nil {
+			if options.Strict {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	textures := make(map[textureKey]*ImageTexture)
+	for _, m := range materials {
+		m.loadMaps(textures)
+	}
+	return materials, nil
+}
+
+// parseStatement applies a statement to the material, which is left as it was when the statement
+// can't be read
+func (m *Material) parseStatement(keyword string, args []string, dir string, confined bool) error {
+	switch keyword {
+	case "ka", "kd", "ks", "ke":
+		c, err := parseMTLColor(args)
+		if err != nil {
+			return err
+		}
+		switch keyword {
+		case "ka":
+			m.Ambient = c
+		case "kd":
+			m.Diffuse = c
+		case "ks":
+			m.Specular = c
+		default:
+			m.Emission = c
+		}
+	case "ns", "ni", "d", "tr":
+		// d may be written "d -halo 0.5", the halo form is treated as plain dissolve
+		if keyword == "d" && len(args) > 1 && args[0] == "-halo" {
+			args = args[1:]
+		}
+		f, err := parseMTLFloat(args)
+		if err != nil {
+			return err
+		}
+		switch keyword {
+		case "ns":
+			m.Shininess = f
+		case "ni":
+			m.IOR = f
+		case "d":
+			m.Opacity = f
+		default:
+			m.Opacity = 1 - f
+		}
+	case "illum":
+		if len(args) != 1 {
+			return fmt.Errorf("illum takes one argument")
+		}
+		illum, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+		m.Illum = illum
+	case "bump", "disp", "decal", "refl", "norm":
+		return m.parseMap("map_"+keyword, args, dir, confined)
+	default:
+		if strings.HasPrefix(keyword, "map_") {
+			return m.parseMap(keyword, args, dir, confined)
+		}
+		// Statements we don't render, like Tf or sharpness, are ignored
+	}
+	return nil
+}
+
+// parseMap reads a texture map statement, options followed by a file name that may contain spaces
+func (m *Material) parseMap(keyword string, args []string, dir string, confined bool) error {
+	tm := TextureMap{Options: make(map[string][]string), Scale: Vec3{1, 1, 1}, Bump: 1}
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+		name := args[0][1:]
+		n, ok := mapOptionArgs[name]
+		if !ok {
+			return fmt.Errorf("unknown %s option %s", keyword, args[0])
+		}
+		args = args[1:]
+		var values []string
+		for len(values) < n && len(args) > 1 {
+			// -o, -s and -t take one to three numbers
+			if len(values) > 0 && n == 3 {
+				if _, err := strconv.ParseFloat(args[0], 64); err != nil {
+					break
+				}
+			}
+			values = append(values, args[0])
+			args = args[1:]
+		}
+		tm.Options[name] = values
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%s has no file", keyword)
+	}
+	var err error
+	if s, ok := tm.Options["s"]; ok {
+		if tm.Scale, err = parseMapVector(s, tm.Scale); err != nil {
+			return fmt.Errorf("%s -s: %v", keyword, err)
+		}
+	}
+	if o, ok := tm.Options["o"]; ok {
+		if tm.Offset, err = parseMapVector(o, tm.Offset); err != nil {
+			return fmt.Errorf("%s -o: %v", keyword, err)
+		}
+	}
+	if bm, ok := tm.Options["bm"]; ok {
+		if len(bm) != 1 {
+			return fmt.Errorf("%s -bm takes one value", keyword)
+		}
+		if tm.Bump, err = strconv.ParseFloat(bm[0], 64); err != nil {
+			return fmt.Errorf("%s -bm: %v", keyword, err)
+		}
+	}
+	if c, ok := tm.Options["clamp"]; ok && len(c) == 1 && c[0] == "on" {
+		tm.Wrap = WrapClamp
+	}
+	if tm.Path, err = localFile(dir, strings.Join(args, " "), confined); err != nil {
+		return fmt.Errorf("%s: %v", keyword, err)
+	}
+	m.Maps[keyword] = tm
+	return nil
+}
+
+// parseMapVector reads the one to three numbers of a map option, the missing ones keep their defaults
+func parseMapVector(args []string, v Vec3) (Vec3, error) {
+	f, err := parseFloats(args)
+	if err != nil {
+		return v, err
+	}
+	switch len(f) {
+	case 3:
+		v.Z = f[2]
+		fallthrough
+	case 2:
+		v.Y = f[1]
+		fallthrough
+	case 1:
+		v.X = f[0]
+	}
+	return v, nil
+}
+
+// renderedMaps lists the texture maps used for rendering, and whether each holds sRGB colors.
+// Bump and normal maps hold linear data.
+var renderedMaps = map[string]bool{"map_kd": true, "map_bump": false, "map_norm": false}
+
+// textureKey identifies an image loaded as sRGB or linear data
+type textureKey struct {
+	path string
+	srgb bool
+}
+
+// loadMaps reads the images of the texture maps used for rendering, sharing the images already in
+// textures. A map that can't be loaded is reported and left without an image.
+func (m *Material) loadMaps(textures map[textureKey]*ImageTexture) {
+	for keyword, tm := range m.Maps {
+		srgb, ok := renderedMaps[keyword]
+		if !ok {
+			continue
+		}
+		key := textureKey{tm.Path, srgb}
+		img, ok := textures[key]
+		if !ok {
+			var err error
+			if img, err = LoadImageTexture(tm.Path, srgb); err != nil {
+				fmt.Fprintf(os.Stderr, "material %s: %v\n", m.Name, err)
+			}
+			textures[key] = img
+		}
+		tm.Image = img
+		m.Maps[keyword] = tm
+	}
+}
+
+// parseMTLColor reads an RGB color, a single value is gray. Spectral curves aren't supported, and
+// CIE XYZ values are read as RGB.
+func parseMTLColor(args []string) (Vec3, error) {
+	if len(args) > 0 && args[0] == "spectral" {
+		return zeroVec, fmt.Errorf("spectral colors aren't supported")
+	}
+	if len(args) > 0 && args[0] == "xyz" {
+		args = args[1:]
+	}
+	var f [3]float64
+	if len(args) != 1 && len(args) != 3 {
+		return zeroVec, fmt.Errorf("color needs one or three values, got %d", len(args))
+	}
+	for i, arg := range args {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return zeroVec, err
+		}
+		f[i] = v
+	}
+	if len(args) == 1 {
+		return Vec3{f[0], f[0], f[0]}, nil
+	}
+	return Vec3{f[0], f[1], f[2]}, nil
+}
+
+func parseMTLFloat(args []string) (float64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected one value, got %d", len(args))
+	}
+	return strconv.ParseFloat(args[0], 64)
+}
@@ -20,24 +20,70 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
 
-func parseIndex(value string, length int) int {
-	parsed, err := strconv.Atoi(value)
-	if err != nil {
-		//		fmt.Fprintln(os.Stderr, err)
-	}
-	if parsed < 0 {
-		parsed += length
-	}
-	return parsed
+// maxOBJLine is the longest line, continuations included, an OBJ file may have
+const maxOBJLine = 64 << 20
+
+// OBJOptions controls how malformed OBJ input is handled and how missing normals are made
+type OBJOptions struct {
+	// Strict makes a malformed statement an error, otherwise it is reported on stderr and skipped
+	Strict bool
+	// CreaseAngle is the angle in degrees between faces above which they aren't smoothed into each
+	// other where they lack normals. 0 leaves every face flat, 180 smooths across every edge.
+	CreaseAngle float64
+	// Confined keeps the MTL libraries and texture maps the file names inside its directory, for files
+	// from untrusted sources
+	Confined bool
 }
 
-// OpenOBJ takes the path to an obj file and returns a Mesh pointer
+// defaultCreaseAngle is the crease angle of OpenOBJ, and of scene meshes that don't give one
+const defaultCreaseAngle = 60
+
+// autoSmoothing is the smoothing group of faces before any s statement, which are smoothed into
+// each other only by the crease angle
+const autoSmoothing = math.MaxUint32
+
+// objParser holds the state of an OBJ file being read
+type objParser struct {
+	path    string
+	options OBJOptions
+	// m holds the vertices and faces read so far. Index 0 of each vertex list is a zero placeholder
+	// for omitted indices, as in a Mesh.
+	m         *Mesh
+	params    []Vec3
+	materials map[string]*Material
+	material  *Material
+	// materialIndex is the index of material in the mesh
+	materialIndex uint32
+	object        string
+	group         string
+	groups        []MeshGroup
+	// smoothing is the current smoothing group, 0 when smoothing is off, and smoothings holds the
+	// group of each face
+	smoothing  uint32
+	smoothings []uint32
+	// skipped counts the statements of unsupported element types
+	skipped map[string]int
+}
+
+// OpenOBJ takes the path to an obj file and returns a Mesh pointer.
+// Materials come from the MTL files named by mtllib, which must be inside the directory of the obj file.
+// Malformed statements are reported on stderr and skipped, and faces without normals are smoothed up to
+// defaultCreaseAngle.
 func OpenOBJ(path string) (*Mesh, error) {
+	return OpenOBJWith(path, OBJOptions{CreaseAngle: defaultCreaseAngle})
+}
+
+// OpenOBJWith reads the obj file at path like OpenOBJ, with the given options
+func OpenOBJWith(path string, options OBJOptions) (*Mesh, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -47,60 +93,352 @@ func OpenOBJ(path string) (*Mesh, error) {
 			fmt.Fprintln(os.Stderr, err)
 		}
 	}()
-	// Allocate slices to store data
-	vectors := make([]Vec3, 1, 1024)
-	textures := make([]Vec3, 1, 1024)
-	normals := make([]Vec3, 1, 1024)
-	var triangles []*Triangle
-	scanner := bufio.NewScanner(file)
+	return ParseOBJ(file, path, options)
+}
+
+// ParseOBJ reads an obj file from r. Errors and warnings are prefixed with path, which also
+// locates the MTL files named by mtllib.
+func ParseOBJ(r io.Reader, path string, options OBJOptions) (*Mesh, error) {
+	p := &objParser{path: path, options: options, m: newMesh(), params: make([]Vec3, 1),
+		materials: make(map[string]*Material), smoothing: autoSmoothing, skipped: make(map[string]int)}
+	p.startGroup()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxOBJLine)
+	line := 0
 	for scanner.Scan() {
-		line := scanner.Text()
-		fields := strings.Fields(line)
+		line++
+		start := line
+		text := stripOBJComment(scanner.Text())
+		// A backslash at the end of a line joins the next one to it
+		for strings.HasSuffix(text, "\\") {
+			text = text[:len(text)-1]
+			if !scanner.Scan() {
+				break
+			}
+			line++
+			text += " " + stripOBJComment(scanner.Text())
+			if len(text) > maxOBJLine {
+				return nil, fmt.Errorf("%s:%d: statement too long", path, start)
+			}
+		}
+		fields := strings.Fields(text)
 		if len(fields) == 0 {
 			continue
 		}
-		keyword := fields[0]
-		args := fields[1:]
-		switch keyword {
-		case "v":
-			f := parseFloats(args)
-			v := Vec3{f[0], f[1], f[2]}
-			vectors = append(vectors, v)
-		case "vt":
-			f := parseFloats(args)
-			v := Vec3{f[0], f[1], 0}
-			textures = append(textures, v)
-		case "vn":
-			f := parseFloats(args)
-			v := Vec3{f[0], f[1], f[2]}
-			normals = append(normals, v)
-		case "f":
-			fVectors := make([]int, len(args))
-			fTextures := make([]int, len(args))
-			fNormals := make([]int, len(args))
-			for i, arg := range args {
-				vertex := strings.Split(arg+"//", "/")
-				fVectors[i] = parseIndex(vertex[0], len(vectors))
-				fTextures[i] = parseIndex(vertex[1], len(textures))
-				fNormals[i] = parseIndex(vertex[2], len(normals))
+		if err := p.statement(fields[0], fields[1:]); err != nil {
+			if options.Strict {
+				return nil, fmt.Errorf("%s:%d: %v", path, start, err)
 			}
-			for i := 1; i < len(fVectors)-1; i++ {
-				i1, i2, i3 := 0, i, i+1
-				t := Triangle{}
-				t.V1 = vectors[fVectors[i1]]
-				t.V2 = vectors[fVectors[i2]]
-				t.V3 = vectors[fVectors[i3]]
-				t.T1 = textures[fTextures[i1]]
-				t.T2 = textures[fTextures[i2]]
-				t.T3 = textures[fTextures[i3]]
-				t.N1 = normals[fNormals[i1]]
-				t.N2 = normals[fNormals[i2]]
-				t.N3 = normals[fNormals[i3]]
-				t.fixNormals()
-				triangles = append(triangles, &t)
+			fmt.Fprintf(os.Stderr, "%s:%d: %v\n", path, start, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s:%d: %v", path, line+1, err)
+	}
+	p.reportSkipped()
+	if len(p.m.faces) == 0 {
+		return nil, fmt.Errorf("%s: no faces", path)
+	}
+	return p.mesh(), nil
+}
+
+// stripOBJComment removes a # comment and trailing white space from a line
+func stripOBJComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimRight(line, " \t\r")
+}
+
+func (p *objParser) statement(keyword string, args []string) error {
+	switch keyword {
+	case "v":
+		// Some exporters append a vertex color, which is ignored. A vertex that can't be read is
+		// still added so the indices of the vertices after it stay right.
+		v, err := parseOBJVector(args, 3, 7)
+		p.m.positions = append(p.m.positions, v)
+		return err
+	case "vt":
+		v, err := parseOBJVector(args, 1, 3)
+		p.m.uvs = append(p.m.uvs, Vec3{v.X, v.Y, 0})
+		return err
+	case "vn":
+		v, err := parseOBJVector(args, 3, 3)
+		p.m.normals = append(p.m.normals, v)
+		return err
+	case "vp":
+		v, err := parseOBJVector(args, 1, 3)
+		p.params = append(p.params, v)
+		return err
+	case "f":
+		return p.face(args)
+	case "mtllib":
+		return p.mtllib(args)
+	case "usemtl":
+		name := strings.Join(args, " ")
+		p.material = p.materials[name]
+		p.materialIndex = p.m.addMaterial(p.material)
+		p.startGroup()
+		if p.material == nil {
+			return fmt.Errorf("unknown material %q, using the mesh color", name)
+		}
+	case "o":
+		p.object = strings.Join(args, " ")
+		p.group = ""
+		p.startGroup()
+	case "g":
+		p.group = strings.Join(args, " ")
+		p.startGroup()
+	case "s":
+		return p.smoothingGroup(args)
+	case "l", "p", "curv", "curv2", "surf":
+		p.skipped[keyword]++
+	}
+	// Other statements, like free-form attributes, don't affect the mesh
+	return nil
+}
+
+// parseOBJVector reads between min and max numbers, a Vec3 holds the first three
+func parseOBJVector(args []string, min, max int) (Vec3, error) {
+	var f [3]float64
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return Vec3{}, fmt.Errorf("expected %d numbers, got %d", min, len(args))
+		}
+		return Vec3{}, fmt.Errorf("expected %d to %d numbers, got %d", min, max, len(args))
+	}
+	values, err := parseFloats(args)
+	if err != nil {
+		return Vec3{}, err
+	}
+	for i, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Vec3{}, fmt.Errorf("%q isn't a finite number", args[i])
+		}
+		if i < 3 {
+			f[i] = v
+		}
+	}
+	return Vec3{f[0], f[1], f[2]}, nil
+}
+
+// face triangulates a polygon as a fan around its first vertex
+func (p *objParser) face(args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("face has %d vertices, it needs at least 3", len(args))
+	}
+	fVectors := make([]uint32, len(args))
+	fTextures := make([]uint32, len(args))
+	fNormals := make([]uint32, len(args))
+	for i, arg := range args {
+		vertex := strings.Split(arg, "/")
+		if len(vertex) > 3 {
+			return fmt.Errorf("face vertex %q has more than three indices", arg)
+		}
+		vertex = append(vertex, "", "")
+		var err error
+		if fVectors[i], err = parseIndex(vertex[0], len(p.m.positions)); err != nil {
+			return fmt.Errorf("vertex index of %q: %v", arg, err)
+		}
+		if fVectors[i] == 0 {
+			return fmt.Errorf("face vertex %q has no vertex index", arg)
+		}
+		if fTextures[i], err = parseIndex(vertex[1], len(p.m.uvs)); err != nil {
+			return fmt.Errorf("texture index of %q: %v", arg, err)
+		}
+		if fNormals[i], err = parseIndex(vertex[2], len(p.m.normals)); err != nil {
+			return fmt.Errorf("normal index of %q: %v", arg, err)
+		}
+	}
+	for i := 1; i < len(fVectors)-1; i++ {
+		i1, i2, i3 := 0, i, i+1
+		p.m.faces = append(p.m.faces, meshFace{
+			[3]uint32{fVectors[i1], fVectors[i2], fVectors[i3]},
+			[3]uint32{fNormals[i1], fNormals[i2], fNormals[i3]},
+			[3]uint32{fTextures[i1], fTextures[i2], fTextures[i3]},
+			p.materialIndex})
+		p.smoothings = append(p.smoothings, p.smoothing)
+	}
+	return nil
+}
+
+// smoothingGroup reads an s statement, a group number or off
+func (p *objParser) smoothingGroup(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("smoothing group needs one argument, got %d", len(args))
+	}
+	if args[0] == "off" {
+		p.smoothing = 0
+		return nil
+	}
+	group, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || group == autoSmoothing {
+		return fmt.Errorf("%q isn't a smoothing group", args[0])
+	}
+	p.smoothing = uint32(group)
+	return nil
+}
+
+// parseIndex resolves a 1-based or negative relative index into a list of length elements,
+// counting its placeholder. An empty index is 0.
+func parseIndex(value string, length int) (uint32, error) {
+	if value == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't an index", value)
+	}
+	if parsed < 0 {
+		parsed += length
+	}
+	if parsed <= 0 || parsed >= length {
+		return 0, fmt.Errorf("%s is out of range, there are %d", value, length-1)
+	}
+	return uint32(parsed), nil
+}
+
+// mtllib reads the materials of the MTL files names. A missing library only loses the look of the
+// model, so it's never fatal, a malformed one is in strict mode.
+func (p *objParser) mtllib(names []string) error {
+	dir := filepath.Dir(p.path)
+	for _, name := range names {
+		path, err := localFile(dir, name, p.options.Confined)
+		if err != nil {
+			err = fmt.Errorf("mtllib %v", err)
+		} else {
+			p.m.files = append(p.m.files, path)
+			var library map[string]*Material
+			if library, err = OpenMTL(path, p.options); err == nil {
+				for materialName, m := range library {
+					p.materials[materialName] = m
+				}
+				continue
 			}
 		}
+		if p.options.Strict && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", p.path, err)
+	}
+	return nil
+}
+
+// startGroup begins a new group at the next triangle, replacing the current one if it's empty
+func (p *objParser) startGroup() {
+	if n := len(p.groups); n > 0 && p.groups[n-1].First == len(p.m.faces) {
+		p.groups = p.groups[:n-1]
+	}
+	p.groups = append(p.groups, MeshGroup{p.object, p.group, p.material, len(p.m.faces), 0})
+}
+
+func (p *objParser) reportSkipped() {
+	var keywords []string
+	for keyword := range p.skipped {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		fmt.Fprintf(os.Stderr, "%s: skipped %d unsupported %q elements\n", p.path, p.skipped[keyword], keyword)
+	}
+}
+
+func (p *objParser) mesh() *Mesh {
+	groups := p.groups
+	if n := len(groups); groups[n-1].First == len(p.m.faces) {
+		groups = groups[:n-1]
+	}
+	for i := range groups {
+		end := len(p.m.faces)
+		if i+1 < len(groups) {
+			end = groups[i+1].First
+		}
+		groups[i].Count = end - groups[i].First
 	}
+	p.m.groups = groups
+	p.smoothNormals()
+	p.m.finish()
+	return p.m
+}
 
-	return newMesh(triangles), scanner.Err()
+// smoothNormals gives the corners without a normal the average of the normals of the faces around
+// their vertex in the same smoothing group, weighted by the angle of each face at the vertex. Faces
+// meeting the corner's face at more than the crease angle are left out, so hard edges stay sharp.
+// Faces with smoothing off keep the normal of the face. Corners sharing a vertex and an average
+// share a normal.
+func (p *objParser) smoothNormals() {
+	m := p.m
+	smoothed := false
+	for i, f := range m.faces {
+		if p.smoothings[i] != 0 && (f.N[0] == 0 || f.N[1] == 0 || f.N[2] == 0) {
+			smoothed = true
+			break
+		}
+	}
+	if !smoothed || p.options.CreaseAngle == 0 {
+		return
+	}
+	minCos := math.Cos(math.Min(p.options.CreaseAngle, 180) * math.Pi / 180)
+	faceNormals := make([]Vec3, len(m.faces))
+	for i, f := range m.faces {
+		n := crossProduct(m.positions[f.V[1]].Sub(m.positions[f.V[0]]), m.positions[f.V[2]].Sub(m.positions[f.V[0]]))
+		if n != zeroVec {
+			faceNormals[i] = n.Normalize()
+		}
+	}
+	// The smoothed faces around each vertex are around[start[v]:start[v+1]]
+	start := make([]uint32, len(m.positions)+1)
+	for i, f := range m.faces {
+		if p.smoothings[i] != 0 && faceNormals[i] != zeroVec {
+			for _, v := range f.V {
+				start[v+1]++
+			}
+		}
+	}
+	for v := 1; v < len(start); v++ {
+		start[v] += start[v-1]
+	}
+	around := make([]uint32, start[len(start)-1])
+	next := append([]uint32(nil), start[:len(start)-1]...)
+	for i, f := range m.faces {
+		if p.smoothings[i] != 0 && faceNormals[i] != zeroVec {
+			for _, v := range f.V {
+				around[next[v]] = uint32(i)
+				next[v]++
+			}
+		}
+	}
+	type vertexNormal struct {
+		v uint32
+		n Vec3
+	}
+	shared := make(map[vertexNormal]uint32)
+	for i := range m.faces {
+		f := &m.faces[i]
+		if p.smoothings[i] == 0 || faceNormals[i] == zeroVec {
+			continue
+		}
+		for j, v := range f.V {
+			if f.N[j] != 0 {
+				continue
+			}
+			var sum Vec3
+			for _, g := range around[start[v]:start[v+1]] {
+				if p.smoothings[g] == p.smoothings[i] && dotProduct(faceNormals[g], faceNormals[i]) >= minCos {
+					sum = sum.Add(faceNormals[g].Mul(m.cornerAngle(g, v)))
+				}
+			}
+			if sum == zeroVec {
+				continue
+			}
+			key := vertexNormal{v, sum.Normalize()}
+			n, ok := shared[key]
+			if !ok {
+				m.normals = append(m.normals, key.n)
+				n = uint32(len(m.normals) - 1)
+				shared[key] = n
+			}
+			f.N[j] = n
+		}
+	}
 }
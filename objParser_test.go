@@ -0,0 +1,119 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzParseOBJ checks that ParseOBJ never panics, that every mesh it returns only refers to vertices it
+// has, and that input strict mode accepts is accepted leniently too
+func FuzzParseOBJ(f *testing.F) {
+	teapot, err := os.ReadFile("teapot.obj")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(string(teapot))
+	for _, seed := range []string{
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nvt 0 0\nvn 0 0 1\nf 1/1/1 2/1/1 3/1/1\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nv 1 1 0\nf -4 -3 -2 -1\n",
+		"v 0 0 0 1 0.5 0\nv 1 0 0\nv 0 1 0 # color\nf 1 2 3\n",
+		"v 0 0\nv nan 0 0\nv 1e999 0 0\nv 1 x 0\nf 1 2 3\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 0 1 2\nf 1 2 4\nf 1 2\nf 1/1/1/1 2 3\n",
+		"v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1//9 2 3\nf 1 2 99999999999999999999\nf -4 1 2\n",
+		"v 0 0 0\\\n 1 0 0\nv 0 1 0\nv 1 1 0\nf 1 2 \\\n3\nf 1 2 3 \\",
+		"vp 0.5\nl 1 2\np 1\ncurv 0 1 1 2\nsurf 0 1 0 1 1 2\ns off\ns 1\ns x\nusemtl missing\nmtllib missing.mtl\n",
+		"",
+	} {
+		f.Add(seed)
+	}
+	// Libraries named by the input are looked up in an empty directory
+	path := filepath.Join(f.TempDir(), "fuzz.obj")
+	f.Fuzz(func(t *testing.T, data string) {
+		lenient, lenientErr := ParseOBJ(strings.NewReader(data), path, OBJOptions{CreaseAngle: defaultCreaseAngle})
+		strict, strictErr := ParseOBJ(strings.NewReader(data), path, OBJOptions{Strict: true, CreaseAngle: defaultCreaseAngle})
+		if strictErr == nil && lenientErr != nil {
+			t.Fatalf("strict mode accepted what lenient mode refused: %v", lenientErr)
+		}
+		for _, m := range []*Mesh{lenient, strict} {
+			if m == nil {
+				continue
+			}
+			if len(m.faces) == 0 {
+				t.Fatal("mesh has no faces")
+			}
+			for i, face := range m.faces {
+				for j := 0; j < 3; j++ {
+					if int(face.V[j]) >= len(m.positions) || int(face.N[j]) >= len(m.normals) ||
+						int(face.T[j]) >= len(m.uvs) {
+						t.Fatalf("face %d refers to a missing vertex: %+v", i, face)
+					}
+				}
+				if int(face.Material) >= len(m.materials) {
+					t.Fatalf("face %d refers to a missing material: %+v", i, face)
+				}
+			}
+		}
+	})
+}
+
+// TestOBJConfined checks that libraries and maps outside the directory of the OBJ file are read unless
+// the file is confined to it
+func TestOBJConfined(t *testing.T) {
+	dir := t.TempDir()
+	texture := filepath.Join(dir, "red.png")
+	files := map[string]string{
+		"shared/red.mtl": "newmtl red\nKd 1 0 0\nmap_Kd " + texture + "\n",
+		"model/red.obj":  "mtllib ../shared/red.mtl\nusemtl red\nv 0 0 0\nv 1 0 0\nv 0 1 0\nf 1 2 3\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "model", "red.obj")
+	m, err := OpenOBJWith(path, OBJOptions{CreaseAngle: defaultCreaseAngle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.materials) != 2 || m.materials[1].Maps["map_kd"].Path != texture {
+		t.Fatalf("unconfined OBJ file didn't read its library and map: %+v", m.materials)
+	}
+	if m, err = OpenOBJWith(path, OBJOptions{CreaseAngle: defaultCreaseAngle, Confined: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.materials) != 1 {
+		t.Fatalf("confined OBJ file read a library outside its directory: %+v", m.materials)
+	}
+	// A confined library can't name maps outside its directory either
+	library, err := OpenMTL(filepath.Join(dir, "shared", "red.mtl"), OBJOptions{Confined: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := library["red"].Maps["map_kd"]; ok {
+		t.Fatal("confined library kept a map outside its directory")
+	}
+}
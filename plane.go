@@ -17,11 +17,20 @@ package main
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
+import (
+	"math"
+)
+
 // Plane is used to store information regarding an infinity plane
 type Plane struct {
 	Point  Vec3
 	Normal Vec3
 	color  Vec3
+	// texture, when set, replaces color
+	texture Texture
+	space   TextureSpace
+	// culling is the side of the plane rays miss
+	culling Culling
 }
 
 // Color returns the color of the plane, used to fufill Geometry interface
@@ -29,14 +38,41 @@ func (p *Plane) Color() Vec3 {
 	return p.color
 }
 
-// IntersectHit performs an intersection test on the plan and returns a Hit
+// ColorAt returns the color of the plane at a hit. Textures get the distances along two axes in the
+// plane as texture coordinates, and points relative to Point in object space.
+func (p *Plane) ColorAt(hit Hit) Vec3 {
+	if p.texture == nil {
+		return p.color
+	}
+	local := hit.Point.Sub(p.Point)
+	// Any axis not parallel to the normal gives a basis in the plane
+	axis := Vec3{0, 1, 0}
+	if math.Abs(p.Normal.Y) > 0.9 {
+		axis = Vec3{1, 0, 0}
+	}
+	tangent := crossProduct(p.Normal, axis).Normalize()
+	bitangent := crossProduct(p.Normal, tangent)
+	uv := Vec3{dotProduct(local, tangent), dotProduct(local, bitangent), 0}
+	if p.space == WorldSpace {
+		return p.texture.At(hit.Point, uv)
+	}
+	return p.texture.At(local, uv)
+}
+
+// IntersectHit performs an intersection test on the plane and returns a Hit, with the normal turned
+// to face the ray. Rays travelling against the normal hit the front.
 func (p *Plane) IntersectHit(r Ray) Hit {
 	denom := dotProduct(p.Normal, r.Direction)
-	if denom > EPSILON {
-		p0l0 := p.Point.Sub(r.Origin)
-		t := dotProduct(p0l0, p.Normal) / denom
-		return Hit{t, r.Origin.Add(r.Direction.Mul(t)), p.Normal}
+	if math.Abs(denom) < EPSILON || (denom > 0 && p.culling == CullBack) || (denom < 0 && p.culling == CullFront) {
+		return NoHit
 	}
-
-	return NoHit
+	t := dotProduct(p.Point.Sub(r.Origin), p.Normal) / denom
+	if t < EPSILON {
+		return NoHit
+	}
+	n := p.Normal
+	if denom > 0 {
+		n = n.Mul(-1)
+	}
+	return Hit{t, r.Origin.Add(r.Direction.Mul(t)), n, zeroVec, nil, nil, 0, nil, zeroVec, zeroVec}
 }
@@ -0,0 +1,483 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// plyFormat is the encoding of the body of a PLY file
+type plyFormat int
+
+const (
+	plyASCII plyFormat = iota
+	plyLittleEndian
+	plyBigEndian
+)
+
+// plyTypes maps the scalar type names of PLY headers, old and new, to their sizes in bytes
+var plyTypes = map[string]int{
+	"char": 1, "int8": 1, "uchar": 1, "uint8": 1,
+	"short": 2, "int16": 2, "ushort": 2, "uint16": 2,
+	"int": 4, "int32": 4, "uint": 4, "uint32": 4,
+	"float": 4, "float32": 4, "double": 8, "float64": 8,
+}
+
+// plyProperty is a property of a PLY element. List properties have a count type and an item type,
+// scalar properties only an item type.
+type plyProperty struct {
+	name      string
+	countType string
+	itemType  string
+}
+
+type plyElement struct {
+	name       string
+	count      int
+	properties []plyProperty
+}
+
+// plyReader reads the scalars of the body of a PLY file
+type plyReader struct {
+	format plyFormat
+	r      *bufio.Reader
+	buf    [8]byte
+}
+
+// OpenPLY reads the mesh of a PLY file, ASCII or binary. Vertices may have normals (nx, ny, nz),
+// colors (red, green, blue) and texture coordinates (u, v or s, t), and faces are polygons that are
+// triangulated as fans. Vertex colors are read as sRGB and color the triangles.
+func OpenPLY(path string) (*Mesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return ParsePLY(file, path)
+}
+
+// ParsePLY reads a PLY file from r, prefixing errors with path
+func ParsePLY(r io.Reader, path string) (*Mesh, error) {
+	br := bufio.NewReader(r)
+	format, elements, err := readPLYHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pr := &plyReader{format: format, r: br}
+	m := newMesh()
+	var normals, uvs bool
+	for _, e := range elements {
+		switch e.name {
+		case "vertex":
+			if normals, uvs, err = pr.vertices(e, m); err != nil {
+				return nil, fmt.Errorf("%s: vertex %d: %v", path, len(m.positions)-1, err)
+			}
+		case "face":
+			if err = pr.faces(e, m, normals, uvs); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		default:
+			if err := pr.skip(e); err != nil {
+				return nil, fmt.Errorf("%s: element %s: %v", path, e.name, err)
+			}
+		}
+	}
+	if len(m.faces) == 0 {
+		return nil, fmt.Errorf("%s: no faces", path)
+	}
+	m.finish()
+	return m, nil
+}
+
+// readPLYHeader reads the header up to and including end_header
+func readPLYHeader(r *bufio.Reader) (plyFormat, []plyElement, error) {
+	var format plyFormat
+	var elements []plyElement
+	formatSeen := false
+	for line := 1; ; line++ {
+		text, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("header has no end_header")
+			}
+			return format, nil, err
+		}
+		fields := strings.Fields(text)
+		if line == 1 {
+			if len(fields) != 1 || fields[0] != "ply" {
+				return format, nil, fmt.Errorf("not a PLY file")
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "comment", "obj_info":
+		case "format":
+			if len(fields) != 3 {
+				return format, nil, fmt.Errorf("header line %d: format takes a type and a version", line)
+			}
+			switch fields[1] {
+			case "ascii":
+				format = plyASCII
+			case "binary_little_endian":
+				format = plyLittleEndian
+			case "binary_big_endian":
+				format = plyBigEndian
+			default:
+				return format, nil, fmt.Errorf("header line %d: unknown format %q", line, fields[1])
+			}
+			formatSeen = true
+		case "element":
+			if len(fields) != 3 {
+				return format, nil, fmt.Errorf("header line %d: element takes a name and a count", line)
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 {
+				return format, nil, fmt.Errorf("header line %d: bad element count %q", line, fields[2])
+			}
+			elements = append(elements, plyElement{fields[1], count, nil})
+		case "property":
+			if len(elements) == 0 {
+				return format, nil, fmt.Errorf("header line %d: property before element", line)
+			}
+			var p plyProperty
+			switch {
+			case len(fields) == 5 && fields[1] == "list":
+				p = plyProperty{fields[4], fields[2], fields[3]}
+			case len(fields) == 3:
+				p = plyProperty{fields[2], "", fields[1]}
+			default:
+				return format, nil, fmt.Errorf("header line %d: malformed property", line)
+			}
+			for _, t := range []string{p.countType, p.itemType} {
+				if _, ok := plyTypes[t]; t != "" && !ok {
+					return format, nil, fmt.Errorf("header line %d: unknown type %q", line, t)
+				}
+			}
+			e := &elements[len(elements)-1]
+			e.properties = append(e.properties, p)
+		case "end_header":
+			if !formatSeen {
+				return format, nil, fmt.Errorf("header has no format")
+			}
+			return format, elements, nil
+		default:
+			return format, nil, fmt.Errorf("header line %d: unknown keyword %q", line, fields[0])
+		}
+	}
+}
+
+// scalar reads one value of type t
+func (pr *plyReader) scalar(t string) (float64, error) {
+	if pr.format == plyASCII {
+		word, err := pr.word()
+		if err != nil {
+			return 0, err
+		}
+		if t == "float" || t == "float32" || t == "double" || t == "float64" {
+			return strconv.ParseFloat(word, 64)
+		}
+		n, err := strconv.ParseInt(word, 10, 64)
+		return float64(n), err
+	}
+	size := plyTypes[t]
+	b := pr.buf[:size]
+	if _, err := io.ReadFull(pr.r, b); err != nil {
+		return 0, err
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if pr.format == plyBigEndian {
+		order = binary.BigEndian
+	}
+	switch t {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(order.Uint32(b))), nil
+	}
+	return math.Float64frombits(order.Uint64(b)), nil
+}
+
+// word reads the next whitespace separated word of an ASCII body
+func (pr *plyReader) word() (string, error) {
+	var word []byte
+	for {
+		c, err := pr.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(word) > 0 {
+				return string(word), nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if len(word) > 0 {
+				return string(word), nil
+			}
+			continue
+		}
+		word = append(word, c)
+	}
+}
+
+// property reads a property, returning its values. A scalar property has one value.
+func (pr *plyReader) property(p plyProperty, values []float64) ([]float64, error) {
+	values = values[:0]
+	n := 1
+	if p.countType != "" {
+		count, err := pr.scalar(p.countType)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 || count > math.MaxInt32 {
+			return nil, fmt.Errorf("%s has %v items", p.name, count)
+		}
+		n = int(count)
+	}
+	for i := 0; i < n; i++ {
+		v, err := pr.scalar(p.itemType)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.name, err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// skip reads past the instances of an element the mesh doesn't use
+func (pr *plyReader) skip(e plyElement) error {
+	var values []float64
+	for i := 0; i < e.count; i++ {
+		for _, p := range e.properties {
+			var err error
+			if values, err = pr.property(p, values); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// plyVertex is a vertex read from a PLY file
+type plyVertex struct {
+	position, normal, uv, color Vec3
+}
+
+// plyCorner is a corner of a face, the indices of its position, normal and texture coordinates in the mesh
+type plyCorner struct {
+	v, n, t uint32
+}
+
+// vertices reads the vertex element into m, with colors if the vertices have them, and reports
+// whether they have normals and texture coordinates. Vertex i is at index i+1 of the arrays of m.
+func (pr *plyReader) vertices(e plyElement, m *Mesh) (normals, uvs bool, err error) {
+	found := make(map[string]bool)
+	for _, p := range e.properties {
+		found[p.name] = true
+	}
+	for _, name := range []string{"x", "y", "z"} {
+		if !found[name] {
+			return false, false, fmt.Errorf("vertices have no %s", name)
+		}
+	}
+	colored := found["red"] && found["green"] && found["blue"]
+	normals = found["nx"] || found["ny"] || found["nz"]
+	uvs = found["u"] || found["s"] || found["texture_u"] || found["texture_s"] ||
+		found["v"] || found["t"] || found["texture_v"] || found["texture_t"]
+	// The count comes from the file, so it only sizes the arrays up to a point
+	size := 1 + minInt(e.count, 1<<20)
+	m.positions = append(make([]Vec3, 0, size), m.positions...)
+	if normals {
+		m.normals = append(make([]Vec3, 0, size), m.normals...)
+	}
+	if uvs {
+		m.uvs = append(make([]Vec3, 0, size), m.uvs...)
+	}
+	if colored {
+		m.colors = make([]Vec3, 1, size)
+	}
+	var values []float64
+	for i := 0; i < e.count; i++ {
+		var vertex plyVertex
+		for _, p := range e.properties {
+			var err error
+			if values, err = pr.property(p, values); err != nil {
+				return false, false, err
+			}
+			if len(values) != 1 {
+				continue
+			}
+			v := values[0]
+			switch p.name {
+			case "x":
+				vertex.position.X = v
+			case "y":
+				vertex.position.Y = v
+			case "z":
+				vertex.position.Z = v
+			case "nx":
+				vertex.normal.X = v
+			case "ny":
+				vertex.normal.Y = v
+			case "nz":
+				vertex.normal.Z = v
+			case "u", "s", "texture_u", "texture_s":
+				vertex.uv.X = v
+			case "v", "t", "texture_v", "texture_t":
+				vertex.uv.Y = v
+			case "red", "green", "blue":
+				if !colored {
+					continue
+				}
+				// Integer colors run up to the largest value of their type, float colors up to 1
+				if max := plyColorMax(p.itemType); max > 0 {
+					v /= max
+				}
+				switch p.name {
+				case "red":
+					vertex.color.X = v
+				case "green":
+					vertex.color.Y = v
+				default:
+					vertex.color.Z = v
+				}
+			}
+		}
+		if !finite(vertex.position) {
+			return false, false, fmt.Errorf("position isn't finite")
+		}
+		m.positions = append(m.positions, vertex.position)
+		if normals {
+			m.normals = append(m.normals, vertex.normal)
+		}
+		if uvs {
+			m.uvs = append(m.uvs, vertex.uv)
+		}
+		if colored {
+			vertex.color.sRGBToLinear()
+			m.colors = append(m.colors, vertex.color)
+		}
+	}
+	return normals, uvs, nil
+}
+
+// plyColorMax returns the value of full intensity for colors of type t, 0 for floating point types
+func plyColorMax(t string) float64 {
+	switch t {
+	case "char", "int8":
+		return math.MaxInt8
+	case "uchar", "uint8":
+		return math.MaxUint8
+	case "short", "int16":
+		return math.MaxInt16
+	case "ushort", "uint16":
+		return math.MaxUint16
+	case "int", "int32":
+		return math.MaxInt32
+	case "uint", "uint32":
+		return math.MaxUint32
+	}
+	return 0
+}
+
+// faces reads the face element into m, triangulating each polygon as a fan around its first vertex.
+// Per corner texture coordinates in a texcoord list take the place of those of the vertices.
+func (pr *plyReader) faces(e plyElement, m *Mesh, normals, uvs bool) error {
+	count := len(m.positions) - 1
+	var values, indices, texcoords []float64
+	var corners []plyCorner
+	for i := 0; i < e.count; i++ {
+		indices, texcoords = indices[:0], texcoords[:0]
+		for _, p := range e.properties {
+			var err error
+			if values, err = pr.property(p, values); err != nil {
+				return fmt.Errorf("face %d: %v", i, err)
+			}
+			switch p.name {
+			case "vertex_indices", "vertex_index":
+				indices = append(indices, values...)
+			case "texcoord":
+				texcoords = append(texcoords, values...)
+			}
+		}
+		if len(indices) < 3 {
+			return fmt.Errorf("face %d has %d vertices, it needs at least 3", i, len(indices))
+		}
+		corners = corners[:0]
+		for j, index := range indices {
+			if index != math.Trunc(index) {
+				return fmt.Errorf("face %d: vertex %v isn't an integer", i, index)
+			}
+			if index < 0 || index >= float64(count) {
+				return fmt.Errorf("face %d: vertex %v is out of range, there are %d", i, index, count)
+			}
+			v := uint32(index) + 1
+			corner := plyCorner{v: v}
+			if normals {
+				corner.n = v
+			}
+			if len(texcoords) == 2*len(indices) {
+				m.uvs = append(m.uvs, Vec3{texcoords[2*j], texcoords[2*j+1], 0})
+				corner.t = uint32(len(m.uvs) - 1)
+			} else if uvs {
+				corner.t = v
+			}
+			corners = append(corners, corner)
+		}
+		for j := 1; j < len(corners)-1; j++ {
+			a, b, c := corners[0], corners[j], corners[j+1]
+			m.faces = append(m.faces, meshFace{[3]uint32{a.v, b.v, c.v}, [3]uint32{a.n, b.n, c.n},
+				[3]uint32{a.t, b.t, c.t}, 0})
+		}
+	}
+	return nil
+}
+
+// finite reports whether v has no infinite or NaN components
+func finite(v Vec3) bool {
+	for _, f := range []float64{v.X, v.Y, v.Z} {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return false
+		}
+	}
+	return true
+}
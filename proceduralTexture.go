@@ -0,0 +1,206 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"math"
+)
+
+// Checker alternates two colors in squares Size wide in texture coordinates
+type Checker struct {
+	Even, Odd Vec3
+	Size      float64
+}
+
+// At returns the color of the square holding uv
+func (c Checker) At(p, uv Vec3) Vec3 {
+	if (int(math.Floor(uv.X/c.Size))+int(math.Floor(uv.Y/c.Size)))&1 == 0 {
+		return c.Even
+	}
+	return c.Odd
+}
+
+// Checker3D alternates two colors in cubes Size wide
+type Checker3D struct {
+	Even, Odd Vec3
+	Size      float64
+}
+
+// At returns the color of the cube holding p
+func (c Checker3D) At(p, uv Vec3) Vec3 {
+	if (int(math.Floor(p.X/c.Size))+int(math.Floor(p.Y/c.Size))+int(math.Floor(p.Z/c.Size)))&1 == 0 {
+		return c.Even
+	}
+	return c.Odd
+}
+
+// NoiseKind selects how NoiseTexture combines octaves of Perlin noise
+type NoiseKind int
+
+const (
+	// NoisePerlin is a single octave of Perlin noise
+	NoisePerlin NoiseKind = iota
+	// NoiseFBM is fractal Brownian motion, octaves of noise at doubling frequency and halving amplitude
+	NoiseFBM
+	// NoiseTurbulence is fBm of the absolute value of the noise, which gives sharp creases
+	NoiseTurbulence
+)
+
+// NoiseTexture blends between two colors by noise of features roughly Scale wide
+type NoiseTexture struct {
+	A, B    Vec3
+	Scale   float64
+	Octaves int
+	Kind    NoiseKind
+}
+
+// At returns the noise at p
+func (n NoiseTexture) At(p, uv Vec3) Vec3 {
+	p = p.Mul(1 / n.Scale)
+	var t float64
+	switch n.Kind {
+	case NoiseFBM:
+		t = 0.5 + 0.5*fbm(p, n.Octaves)
+	case NoiseTurbulence:
+		t = turbulence(p, n.Octaves)
+	default:
+		t = 0.5 + 0.5*perlin(p)
+	}
+	return mixColors(n.A, n.B, t)
+}
+
+// Marble runs veins of B through A along the X axis, Scale apart and bent by turbulence
+type Marble struct {
+	A, B       Vec3
+	Scale      float64
+	Turbulence float64
+	Octaves    int
+}
+
+// At returns the marble at p
+func (m Marble) At(p, uv Vec3) Vec3 {
+	p = p.Mul(1 / m.Scale)
+	t := 0.5 + 0.5*math.Sin(math.Pi*(p.X+m.Turbulence*turbulence(p, m.Octaves)))
+	return mixColors(m.A, m.B, t)
+}
+
+// Wood draws rings of B in A around the Y axis, Scale apart and bent by turbulence
+type Wood struct {
+	A, B       Vec3
+	Scale      float64
+	Turbulence float64
+	Octaves    int
+}
+
+// At returns the wood at p
+func (w Wood) At(p, uv Vec3) Vec3 {
+	p = p.Mul(1 / w.Scale)
+	r := math.Hypot(p.X, p.Z) + w.Turbulence*turbulence(p, w.Octaves)
+	r -= math.Floor(r)
+	// Rings darken quickly and fade out slowly, like growth rings
+	return mixColors(w.A, w.B, math.Pow(1-r, 4))
+}
+
+func mixColors(a, b Vec3, t float64) Vec3 {
+	t = clamp(t, 0, 1)
+	return a.Mul(1 - t).Add(b.Mul(t))
+}
+
+// fbm sums octaves of Perlin noise, staying roughly within [-1, 1]
+func fbm(p Vec3, octaves int) float64 {
+	sum, amplitude, total := 0.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amplitude * perlin(p)
+		total += amplitude
+		amplitude /= 2
+		p = p.Mul(2)
+	}
+	return sum / total
+}
+
+// turbulence sums octaves of the absolute value of Perlin noise, staying roughly within [0, 1]
+func turbulence(p Vec3, octaves int) float64 {
+	sum, amplitude, total := 0.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amplitude * math.Abs(perlin(p))
+		total += amplitude
+		amplitude /= 2
+		p = p.Mul(2)
+	}
+	return sum / total
+}
+
+// perm is a fixed shuffle of 0-255, repeated so lookups can overflow without wrapping
+var perm = func() [512]int {
+	var p [512]int
+	for i := 0; i < 256; i++ {
+		p[i] = i
+	}
+	rng := newPixelRand(0, 0, 0)
+	for i := 255; i > 0; i-- {
+		j := int(rng.next() % uint64(i+1))
+		p[i], p[j] = p[j], p[i]
+	}
+	copy(p[256:], p[:256])
+	return p
+}()
+
+// perlin is Ken Perlin's improved gradient noise, in [-1, 1] and 0 at integer points
+func perlin(p Vec3) float64 {
+	fx, fy, fz := math.Floor(p.X), math.Floor(p.Y), math.Floor(p.Z)
+	x, y, z := int(fx)&255, int(fy)&255, int(fz)&255
+	p.X, p.Y, p.Z = p.X-fx, p.Y-fy, p.Z-fz
+	u, v, w := fade(p.X), fade(p.Y), fade(p.Z)
+	a := perm[x] + y
+	aa, ab := perm[a]+z, perm[a+1]+z
+	b := perm[x+1] + y
+	ba, bb := perm[b]+z, perm[b+1]+z
+	return lerp(w,
+		lerp(v, lerp(u, grad(perm[aa], p.X, p.Y, p.Z), grad(perm[ba], p.X-1, p.Y, p.Z)),
+			lerp(u, grad(perm[ab], p.X, p.Y-1, p.Z), grad(perm[bb], p.X-1, p.Y-1, p.Z))),
+		lerp(v, lerp(u, grad(perm[aa+1], p.X, p.Y, p.Z-1), grad(perm[ba+1], p.X-1, p.Y, p.Z-1)),
+			lerp(u, grad(perm[ab+1], p.X, p.Y-1, p.Z-1), grad(perm[bb+1], p.X-1, p.Y-1, p.Z-1))))
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(t, a, b float64) float64 {
+	return a + t*(b-a)
+}
+
+// grad returns the dot product of (x, y, z) with one of twelve gradient directions chosen by hash
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+	u, v := y, z
+	if h < 8 {
+		u = x
+	}
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
@@ -0,0 +1,95 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"time"
+
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// ProgressiveSettings decides when a progressive render stops, a zero value disables that limit
+type ProgressiveSettings struct {
+	// TargetSamples is the number of samples per pixel to stop at
+	TargetSamples int
+	// TimeBudget is the wall time the render may take
+	TimeBudget time.Duration
+	// NoiseThreshold is the Framebuffer.Noise estimate to stop at
+	NoiseThreshold float64
+	// AdaptiveThreshold stops sampling pixels whose relative error has dropped below it,
+	// so later passes concentrate on the noisy parts of the image
+	AdaptiveThreshold float64
+}
+
+// RenderProgressive renders successive passes over the whole image, accumulating into the framebuffer.
+// Every pass doubles the samples per pixel (1, 2, 4, ...) until one of the limits in settings is reached,
+// or until every pixel has converged in adaptive mode.
+// onPass is called after each pass with the samples per pixel so far and the current noise estimate.
+// A renderer restored from a checkpoint carries on from the pass it was saved in.
+func (renderer *Renderer) RenderProgressive(tiles []rect, settings ProgressiveSettings, onPass func(pass, spp int, noise float64)) {
+	start := time.Now()
+	var perSample time.Duration
+	for {
+		pass, spp := renderer.pass, renderer.spp
+		samples := 1
+		if spp > 0 {
+			samples = spp
+		}
+		if renderer.tileDone != nil {
+			samples = renderer.passSamples
+		}
+		if settings.TargetSamples > 0 && spp+samples > settings.TargetSamples {
+			samples = settings.TargetSamples - spp
+		}
+		// Shrink the pass to what we expect to fit in the remaining time
+		if settings.TimeBudget > 0 && perSample > 0 {
+			fits := int((settings.TimeBudget - time.Since(start)) / perSample)
+			if fits < samples {
+				samples = fits
+			}
+		}
+		if samples <= 0 {
+			return
+		}
+		fmt.Printf("Pass %d: adding %d samples per pixel\n", pass+1, samples)
+		bar := pb.StartNew(len(tiles))
+		passStart := time.Now()
+		sampled := renderer.RenderPass(tiles, samples, settings.AdaptiveThreshold, bar)
+		if renderer.Cancelled() {
+			return
+		}
+		perSample = time.Since(passStart) / time.Duration(samples)
+		spp = renderer.spp
+		noise := renderer.fb.Noise()
+		bar.FinishPrint(fmt.Sprintf("up to %d samples per pixel, %d taken this pass, noise %.4f", spp, sampled, noise))
+		if onPass != nil {
+			onPass(pass, spp, noise)
+		}
+		if settings.NoiseThreshold > 0 && noise < settings.NoiseThreshold {
+			return
+		}
+		if sampled == 0 {
+			fmt.Println("Every pixel has converged")
+			return
+		}
+		if settings.TimeBudget > 0 && time.Since(start) >= settings.TimeBudget {
+			return
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A region render only samples the pixels inside a list of rectangles. The camera still projects the
+// full frame and pixels are seeded the same way, so a region matches the same pixels of a full render
+// and can be pasted straight into it.
+
+// regionList is a flag.Value collecting repeated -region flags
+type regionList []rect
+
+func (l *regionList) String() string {
+	var s []string
+	for _, r := range *l {
+		s = append(s, fmt.Sprintf("%d,%d,%d,%d", r.left, r.top, r.right, r.bottom))
+	}
+	return strings.Join(s, " ")
+}
+
+// Set parses a region written as left,top,right,bottom in pixels, right and bottom exclusive
+func (l *regionList) Set(value string) error {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return fmt.Errorf("region %q isn't left,top,right,bottom", value)
+	}
+	var v [4]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return fmt.Errorf("region %q: %v", value, err)
+		}
+		v[i] = n
+	}
+	r := rect{v[0], v[2], v[1], v[3]}
+	if r.right <= r.left || r.bottom <= r.top {
+		return fmt.Errorf("region %q is empty", value)
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// intersect returns the overlap of r and o, and whether there is any
+func (r rect) intersect(o rect) (rect, bool) {
+	i := rect{maxInt(r.left, o.left), minInt(r.right, o.right), maxInt(r.top, o.top), minInt(r.bottom, o.bottom)}
+	return i, i.left < i.right && i.top < i.bottom
+}
+
+// clipRegions cuts regions down to a w by h image, failing if one lies entirely outside it
+func clipRegions(regions []rect, w, h int) ([]rect, error) {
+	clipped := make([]rect, len(regions))
+	for i, r := range regions {
+		c, ok := r.intersect(rect{0, w, 0, h})
+		if !ok {
+			return nil, fmt.Errorf("region %d,%d,%d,%d is outside the %dx%d image", r.left, r.top, r.right, r.bottom, w, h)
+		}
+		clipped[i] = c
+	}
+	return clipped, nil
+}
+
+// clipTiles returns the tiles that overlap regions, each cut down to the bounding box of its overlaps
+func clipTiles(tiles []rect, regions []rect) []rect {
+	var clipped []rect
+	for _, t := range tiles {
+		var box rect
+		found := false
+		for _, r := range regions {
+			i, ok := t.intersect(r)
+			switch {
+			case !ok:
+			case !found:
+				box, found = i, true
+			default:
+				box = rect{minInt(box.left, i.left), maxInt(box.right, i.right), minInt(box.top, i.top), maxInt(box.bottom, i.bottom)}
+			}
+		}
+		if found {
+			clipped = append(clipped, box)
+		}
+	}
+	return clipped
+}
+
+// regionMask marks the pixels of a w by h image inside any of regions
+func regionMask(w, h int, regions []rect) []bool {
+	mask := make([]bool, w*h)
+	for _, r := range regions {
+		for y := r.top; y < r.bottom; y++ {
+			for x := r.left; x < r.right; x++ {
+				mask[y*w+x] = true
+			}
+		}
+	}
+	return mask
+}
+
+// pasteRegions copies the pixels inside regions from src over dst
+func pasteRegions(dst draw.Image, src image.Image, regions []rect) {
+	for _, r := range regions {
+		area := image.Rect(r.left, r.top, r.right, r.bottom)
+		draw.Draw(dst, area, src, area.Min, draw.Src)
+	}
+}
+
+// readBaseImage reads the w by h PNG at path that regions are pasted into
+func readBaseImage(path string, w, h int) (*image.RGBA, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+		return nil, fmt.Errorf("%s is %dx%d, not %dx%d", path, b.Dx(), b.Dy(), w, h)
+	}
+	base := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(base, base.Bounds(), img, img.Bounds().Min, draw.Src)
+	return base, nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
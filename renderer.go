@@ -19,57 +19,295 @@ package main
 
 import (
 	"image"
-	"image/color"
 	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pb "gopkg.in/cheggaaa/pb.v1"
 )
 
-// Renderer contains the entire scene and rendering channels
+// Renderer contains the entire scene, the framebuffer and the progress of the render
 type Renderer struct {
 	scene      *Scene
 	maxX, maxY int
-	pixelChan  chan Pixel
+	fb         *Framebuffer
 	cam        *Camera
-	jobChan    chan rect
+	// differentials is set when the scene reads image textures, the only lookups camera rays carry
+	// differentials for
+	differentials bool
+	// pool renders the tiles, when nil every pass starts a pool of its own with workers goroutines
+	pool    *WorkerPool
+	workers int
+	// aov, when set, records the primary hit of every pixel
+	aov *AOVBuffers
+	// mask, when set, limits the render to the pixels it marks
+	mask []bool
+	// sampled counts the samples taken during the current pass
+	sampled int64
+	// cancelled is set to 1 by Cancel
+	cancelled int32
+	// wg tracks the tiles of the current pass
+	wg sync.WaitGroup
+	// tileCost is the time spent rendering each tile in the current or last pass, in nanoseconds
+	tileCost []int64
+	// tileParts counts the parts of each split tile that are still being rendered
+	tileParts []int32
+	// splitting counts the split tiles with parts still being rendered
+	splitting int32
+	// tilesDone counts the tiles marked in tileDone, for Progress to read while workers mark them
+	tilesDone int32
+
+	// The progress below is guarded by lock. Workers hold it for reading while they render a tile,
+	// so a checkpoint taken with the write lock, once no split tile is in flight, only ever sees whole
+	// tiles in the framebuffer.
+	lock sync.RWMutex
+	// pass is the index of the pass being rendered, or of the next one between passes
+	pass int
+	// passSamples is the samples per pixel the current pass adds
+	passSamples int
+	// spp is the samples per pixel taken by completed passes
+	spp int
+	// tileDone marks the tiles finished in the current pass, nil between passes
+	tileDone []bool
+}
+
+// job asks a worker to add samples to every pixel of a tile, or of part of it when split is set.
+// When threshold is positive, pixels that have converged below it are skipped.
+type job struct {
+	index     int
+	r         rect
+	samples   int
+	pass      int
+	threshold float64
+	split     bool
 }
 
-// Pixel represents a pixel in the final image
-type Pixel struct {
-	x, y  int
-	color color.Color
+func newRenderer(scene *Scene, cam *Camera, w, h int) *Renderer {
+	return &Renderer{scene: scene, maxX: w, maxY: h, fb: newFramebuffer(w, h), cam: cam,
+		differentials: scene.readsImages(), workers: runtime.NumCPU() * 2}
 }
 
-func (renderer *Renderer) renderRect(r *rect) {
-	for y := r.top; y < r.bottom; y++ {
-		for x := r.left; x < r.right; x++ {
-			// Compute primary ray direction
-			ray := renderer.cam.rayForPixel(x, y)
-			g := renderer.scene.rayTrace(ray, 0)
-			g.linearToSRGB()
-			colour := color.RGBA64{ratioToColor(g.X), ratioToColor(g.Y), ratioToColor(g.Z), 65535}
-			renderer.pixelChan <- Pixel{x, y, colour}
+// cameraRay returns the ray through the point (dx, dy) inside pixel (x, y), with differentials when
+// the scene has image textures to filter
+func (renderer *Renderer) cameraRay(x, y int, dx, dy float64) RayDifferential {
+	if renderer.differentials {
+		return renderer.cam.rayDifferentialForSample(x, y, dx, dy)
+	}
+	return RayDifferential{Ray: renderer.cam.rayForSample(x, y, dx, dy)}
+}
+
+func (renderer *Renderer) renderRect(j *job) int {
+	sampled := 0
+	for y := j.r.top; y < j.r.bottom; y++ {
+		for x := j.r.left; x < j.r.right; x++ {
+			if renderer.mask != nil && !renderer.mask[y*renderer.maxX+x] {
+				continue
+			}
+			if j.threshold > 0 && renderer.fb.Converged(x, y, j.threshold) {
+				continue
+			}
+			// Seed from the pass and pixel so the image doesn't depend on how it was split into tiles
+			// or which worker rendered what
+			rng := newPixelRand(j.pass, x, y)
+			sampled += j.samples
+			for s := 0; s < j.samples; s++ {
+				// The first sample of a pixel goes through its centre, the rest are jittered
+				var ray RayDifferential
+				if renderer.fb.SampleCount(x, y) == 0 {
+					ray = renderer.cameraRay(x, y, 0.5, 0.5)
+					if renderer.aov != nil {
+						renderer.aov.record(x, y, renderer.scene, ray)
+					}
+				} else {
+					ray = renderer.cameraRay(x, y, rng.Float64(), rng.Float64())
+				}
+				renderer.fb.Add(x, y, renderer.scene.rayTrace(ray, 0))
+			}
 		}
 	}
+	return sampled
 }
 
-// CreateImage reads the pixel channel to create the final image
+// CreateImage converts the framebuffer into the final image
 func (renderer *Renderer) CreateImage() *image.RGBA {
-	img := image.NewRGBA(image.Rect(0, 0, renderer.maxX, renderer.maxY))
-	for pixel := range renderer.pixelChan {
-		img.Set(pixel.x, pixel.y, pixel.color)
-	}
-	return img
+	return renderer.fb.Image()
 }
 
-func (renderer *Renderer) worker(bar *pb.ProgressBar) {
-	for r := range renderer.jobChan {
-		renderer.renderRect(&r)
+func (renderer *Renderer) runJob(j *job, bar *pb.ProgressBar) {
+	defer renderer.wg.Done()
+	if renderer.Cancelled() {
+		if j.split && atomic.AddInt32(&renderer.tileParts[j.index], -1) == 0 {
+			atomic.AddInt32(&renderer.splitting, -1)
+		}
+		return
+	}
+	start := time.Now()
+	renderer.lock.RLock()
+	atomic.AddInt64(&renderer.sampled, int64(renderer.renderRect(j)))
+	// A split tile is done when its last part is
+	done := !j.split || atomic.AddInt32(&renderer.tileParts[j.index], -1) == 0
+	if done {
+		renderer.tileDone[j.index] = true
+		atomic.AddInt32(&renderer.tilesDone, 1)
+	}
+	renderer.lock.RUnlock()
+	atomic.AddInt64(&renderer.tileCost[j.index], int64(time.Since(start)))
+	if !done {
+		return
+	}
+	if j.split {
+		atomic.AddInt32(&renderer.splitting, -1)
+	}
+	if bar != nil {
 		bar.Increment()
-		wg.Done()
 	}
 }
 
+// lockWholeTiles takes the write lock once no split tile is partly rendered
+func (renderer *Renderer) lockWholeTiles() {
+	for {
+		renderer.lock.Lock()
+		if atomic.LoadInt32(&renderer.splitting) == 0 {
+			return
+		}
+		renderer.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Cancel stops the render, tiles that haven't started yet are skipped
+func (renderer *Renderer) Cancel() {
+	atomic.StoreInt32(&renderer.cancelled, 1)
+}
+
+// Cancelled reports whether Cancel has been called
+func (renderer *Renderer) Cancelled() bool {
+	return atomic.LoadInt32(&renderer.cancelled) != 0
+}
+
+// Progress returns the samples per pixel of the completed passes, the samples per pixel the current
+// pass adds and how many of its tiles are done
+func (renderer *Renderer) Progress() (spp, passSamples int, tilesDone float64) {
+	renderer.lock.RLock()
+	defer renderer.lock.RUnlock()
+	if renderer.tileDone == nil {
+		return renderer.spp, 0, 0
+	}
+	done := atomic.LoadInt32(&renderer.tilesDone)
+	return renderer.spp, renderer.passSamples, float64(done) / float64(len(renderer.tileDone))
+}
+
+// RenderPass renders the next pass, adding samples to every pixel of the given tiles that hasn't
+// converged below threshold, and blocks until they are done. It returns the number of samples taken.
+// A pass restored from a checkpoint only renders its missing tiles, and keeps its own sample count.
+// The progress bar may be nil. A cancelled pass returns early and is left unfinished.
+//
+// Tiles are handed out in order. Once no more than one tile per worker is left, the expensive ones are
+// split so idle workers can help finish the pass: on the first pass every remaining tile, after that
+// the tiles that took longer than average in the last pass.
+func (renderer *Renderer) RenderPass(tiles []rect, samples int, threshold float64, bar *pb.ProgressBar) int64 {
+	renderer.startPass(len(tiles), samples)
+	pool := renderer.pool
+	if pool == nil {
+		pool = newWorkerPool(renderer.workers)
+		defer pool.Close()
+	}
+	if len(renderer.tileCost) != len(tiles) {
+		renderer.tileCost = make([]int64, len(tiles))
+	}
+	renderer.tileParts = make([]int32, len(tiles))
+	var pending []int
+	var meanCost int64
+	for i := range tiles {
+		meanCost += renderer.tileCost[i] / int64(len(tiles))
+		if renderer.tileDone[i] {
+			if bar != nil {
+				bar.Increment()
+			}
+			continue
+		}
+		pending = append(pending, i)
+	}
+	// Send chunks to workers
+	for k, i := range pending {
+		if renderer.Cancelled() {
+			break
+		}
+		parts := []rect{tiles[i]}
+		if len(pending)-k <= renderer.workers && renderer.tileCost[i] >= meanCost {
+			parts = tiles[i].split()
+		}
+		renderer.tileCost[i] = 0
+		split := len(parts) > 1
+		if split {
+			renderer.tileParts[i] = int32(len(parts))
+			atomic.AddInt32(&renderer.splitting, 1)
+		}
+		for _, r := range parts {
+			renderer.wg.Add(1)
+			pool.jobChan <- poolJob{renderer, job{i, r, renderer.passSamples, renderer.pass, threshold, split}, bar}
+		}
+	}
+	// Wait for all jobs to finish
+	renderer.wg.Wait()
+	if renderer.Cancelled() {
+		return renderer.sampled
+	}
+	return renderer.finishPass()
+}
+
+// startPass prepares the progress of a new pass, unless one was restored from a checkpoint
+func (renderer *Renderer) startPass(tiles, samples int) {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+	if renderer.tileDone == nil {
+		renderer.tileDone = make([]bool, tiles)
+		renderer.passSamples = samples
+		renderer.sampled = 0
+	}
+	done := int32(0)
+	for _, d := range renderer.tileDone {
+		if d {
+			done++
+		}
+	}
+	atomic.StoreInt32(&renderer.tilesDone, done)
+}
+
+// finishPass moves the progress on to the next pass and returns the samples taken in this one
+func (renderer *Renderer) finishPass() int64 {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+	renderer.spp += renderer.passSamples
+	renderer.pass++
+	renderer.tileDone = nil
+	return renderer.sampled
+}
+
+// pixelRand is a splitmix64 generator, cheap enough to seed afresh for every pixel
+type pixelRand uint64
+
+func newPixelRand(pass, x, y int) pixelRand {
+	r := pixelRand(uint64(pass)<<48 ^ uint64(y)<<24 ^ uint64(x))
+	r.next()
+	return r
+}
+
+func (r *pixelRand) next() uint64 {
+	*r += 0x9E3779B97F4A7C15
+	z := uint64(*r)
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// Float64 returns a number in [0, 1)
+func (r *pixelRand) Float64() float64 {
+	return float64(r.next()>>11) / (1 << 53)
+}
+
 // Scene stores all geometry in the scene
 type Scene struct {
 	light    Light
@@ -82,7 +320,8 @@ type Light struct {
 	intensity float64
 }
 
-func (s *Scene) rayTrace(ray Ray, depth int) Vec3 {
+// intersect returns the closest hit of ray in the scene, and the object it hit
+func (s *Scene) intersect(ray Ray) (Hit, Geometry) {
 	var pHit Hit
 	var minDistance = infinity
 	var closestObject Geometry
@@ -98,10 +337,19 @@ func (s *Scene) rayTrace(ray Ray, depth int) Vec3 {
 			}
 		}
 	}
+	return pHit, closestObject
+}
+
+func (s *Scene) rayTrace(ray RayDifferential, depth int) Vec3 {
+	pHit, closestObject := s.intersect(ray.Ray)
 	// If the ray misses
 	if closestObject == nil {
 		return backgroundColor
 	}
+	ray.footprint(&pHit, closestObject)
+	if pHit.Material != nil {
+		return s.shade(ray, pHit, depth)
+	}
 
 	light := s.light.direction.Mul(-1)
 	shadowRay := Ray{pHit.Point.Add(pHit.Normal.Mul(EPSILON)), light}
@@ -114,5 +362,5 @@ func (s *Scene) rayTrace(ray Ray, depth int) Vec3 {
 	albedo := 0.18
 	normalLightProduct := dotProduct(pHit.Normal, light)
 	diffColor := albedo / math.Pi * s.light.intensity * math.Max(0, normalLightProduct)
-	return closestObject.Color().Mul(diffColor)
+	return closestObject.ColorAt(pHit).Mul(diffColor)
 }
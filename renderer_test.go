@@ -0,0 +1,48 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import "testing"
+
+// TestProgressDuringPass polls Progress, as the server's status requests do, while a pass is being
+// rendered. Run with -race, it checks Progress reads the tiles done safely.
+func TestProgressDuringPass(t *testing.T) {
+	desc, scene, camera, tiles, _ := testRender(t)
+	renderer := newRenderer(scene, camera, desc.Width, desc.Height)
+	renderer.workers = 4
+	rendered := make(chan struct{})
+	go func() {
+		renderer.RenderPass(tiles, desc.Samples, 0, nil)
+		close(rendered)
+	}()
+	// The pass is finished once its samples count in spp
+	for last := 0.0; ; {
+		spp, _, done := renderer.Progress()
+		if spp > 0 {
+			break
+		}
+		if done < last || done > 1 {
+			t.Fatalf("progress went from %v to %v", last, done)
+		}
+		last = done
+	}
+	<-rendered
+	if spp, passSamples, done := renderer.Progress(); spp != desc.Samples || passSamples != 0 || done != 0 {
+		t.Errorf("after the pass Progress is %d, %d, %v", spp, passSamples, done)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SceneDescription is the JSON description of a scene, its camera and the image to render.
+// Vectors are written as [x, y, z] arrays.
+type SceneDescription struct {
+	Width   int                 `json:"width"`
+	Height  int                 `json:"height"`
+	Samples int                 `json:"samples"`
+	Camera  CameraDescription   `json:"camera"`
+	Light   LightDescription    `json:"light"`
+	Spheres []SphereDescription `json:"spheres"`
+	Planes  []PlaneDescription  `json:"planes"`
+	Meshes  []MeshDescription   `json:"meshes"`
+	// GLTF is a glTF file whose default scene is added to the scene. The scene is placed in front of
+	// the camera as the glTF camera sees it, and the glTF camera and light replace those of the
+	// description when the glTF scene has them.
+	GLTF string `json:"gltf"`
+}
+
+// CameraDescription describes the camera, FOV defaults to 90 degrees
+type CameraDescription struct {
+	Eye Vec3    `json:"eye"`
+	FOV float64 `json:"fov"`
+}
+
+// LightDescription describes the directional light
+type LightDescription struct {
+	Direction Vec3    `json:"direction"`
+	Intensity float64 `json:"intensity"`
+}
+
+// SphereDescription describes a sphere, a texture replaces its color
+type SphereDescription struct {
+	Center  Vec3                `json:"center"`
+	Radius  float64             `json:"radius"`
+	Color   Vec3                `json:"color"`
+	Texture *TextureDescription `json:"texture"`
+}
+
+// PlaneDescription describes an infinite plane, a texture replaces its color. Cull is none, back or
+// front, the side rays miss, its front being the side Normal points to. Planes are double-sided by default.
+type PlaneDescription struct {
+	Point   Vec3                `json:"point"`
+	Normal  Vec3                `json:"normal"`
+	Color   Vec3                `json:"color"`
+	Texture *TextureDescription `json:"texture"`
+	Cull    string              `json:"cull"`
+}
+
+// MeshDescription describes a mesh loaded from an OBJ, PLY, STL or 3DS file, relative paths are resolved against the
+// directory of the scene file. Strict makes malformed statements in an OBJ file an error instead of a warning.
+// Crease is the crease angle of the normals made for OBJ faces without them, see OBJOptions. It is
+// defaultCreaseAngle when left out, and 0 leaves those faces flat.
+// A texture colors the triangles that have no material. It has no space, it sees points in the coordinates of the
+// mesh after baking, which move with each instance. Recentre, Normalise, Transform and Flip are baked into the
+// vertices in that order, see BakeOptions. Instances, when given, place copies of the mesh sharing its triangles
+// instead of the mesh itself. Cull is like that of planes, but back by default, the front of a triangle being the
+// side it winds counter-clockwise around in the mesh, so mirrored instances cull the same side. Triangles with a
+// double-sided material are never culled.
+type MeshDescription struct {
+	File      string                 `json:"file"`
+	Strict    bool                   `json:"strict"`
+	Crease    *float64               `json:"crease"`
+	Texture   *TextureDescription    `json:"texture"`
+	Recentre  bool                   `json:"recentre"`
+	Normalise bool                   `json:"normalise"`
+	Transform *TransformDescription  `json:"transform"`
+	Flip      bool                   `json:"flip"`
+	Instances []TransformDescription `json:"instances"`
+	Cull      string                 `json:"cull"`
+}
+
+// TransformDescription describes an object-to-world transform: Scale, then a rotation of Angle degrees
+// about Axis, then Translate. A missing Scale is 1.
+type TransformDescription struct {
+	Scale     *Vec3   `json:"scale"`
+	Axis      Vec3    `json:"axis"`
+	Angle     float64 `json:"angle"`
+	Translate Vec3    `json:"translate"`
+}
+
+// TextureDescription describes a texture. Type is one of checker, checker3d, noise, fbm, turbulence,
+// marble, wood or image. Procedural textures blend or alternate between the two Colors, with features
+// Scale wide, and noisy ones sum Octaves octaves of noise, 4 by default and at most maxOctaves. Image
+// textures read File, relative to the scene file, Wrap it with repeat, clamp or mirror, and Filter it
+// with ewa, trilinear or bilinear. Space is world or object, for spheres and planes.
+type TextureDescription struct {
+	Type       string  `json:"type"`
+	Colors     [2]Vec3 `json:"colors"`
+	Scale      float64 `json:"scale"`
+	Octaves    int     `json:"octaves"`
+	Turbulence float64 `json:"turbulence"`
+	File       string  `json:"file"`
+	Wrap       string  `json:"wrap"`
+	Filter     string  `json:"filter"`
+	Space      string  `json:"space"`
+}
+
+// defaultScene is the scene rendered when no scene file is given
+func defaultScene() *SceneDescription {
+	return &SceneDescription{
+		Width:   1920,
+		Height:  1080,
+		Samples: 1,
+		Camera:  CameraDescription{Vec3{0, 1, -2.0}, 90},
+		Light:   LightDescription{Vec3{-1.0, -2.0, 2.0}, 20},
+		Spheres: []SphereDescription{
+			{Vec3{0, 0, 5}, 1.0, Vec3{0, 0.7, 0}, nil},
+			{Vec3{-2, -1.5, 3}, 1.0, Vec3{0.1, 0.9, .7}, nil},
+			{Vec3{-2, 1.5, 5}, 1.0, Vec3{0.9, 0.9, .1}, nil},
+			{Vec3{2, 1.5, 5}, 1.0, Vec3{0.9, 0.1, .9}, nil},
+			{Vec3{2, -1.5, 5}, 1.0, Vec3{0.2, 0.4, .6}, nil},
+		},
+		Meshes: []MeshDescription{{File: "teapot.obj"}},
+	}
+}
+
+// ParseSceneDescription decodes a JSON scene description, filling in defaults for missing settings
+func ParseSceneDescription(data []byte) (*SceneDescription, error) {
+	d := &SceneDescription{Width: 1920, Height: 1080, Samples: 1, Camera: CameraDescription{FOV: 90}}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if err := d.validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// LoadSceneDescription reads a JSON scene description from path. A .gltf or .glb file is read as a
+// description holding only that glTF scene.
+func LoadSceneDescription(path string) (*SceneDescription, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gltf", ".glb":
+		return &SceneDescription{Width: 1920, Height: 1080, Samples: 1, Camera: CameraDescription{FOV: 90},
+			GLTF: filepath.Base(path)}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := ParseSceneDescription(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return d, nil
+}
+
+// Scene descriptions come from the render server too, these bound the memory and time one can ask for
+const (
+	// maxImagePixels allows images up to 8K UHD, or 7680x4320
+	maxImagePixels = 1 << 25
+	maxImageSide   = 16384
+	maxSamples     = 1 << 16
+)
+
+func (d *SceneDescription) validate() error {
+	switch {
+	case d.Width <= 0 || d.Height <= 0:
+		return fmt.Errorf("image size %dx%d isn't positive", d.Width, d.Height)
+	case d.Width > maxImageSide || d.Height > maxImageSide || d.Width*d.Height > maxImagePixels:
+		return fmt.Errorf("image size %dx%d is larger than %d pixels or %d pixels a side", d.Width, d.Height,
+			maxImagePixels, maxImageSide)
+	case d.Samples <= 0:
+		return errors.New("samples must be positive")
+	case d.Samples > maxSamples:
+		return fmt.Errorf("samples must be at most %d", maxSamples)
+	case d.Camera.FOV <= 0 || d.Camera.FOV >= 180:
+		return fmt.Errorf("camera fov %g isn't between 0 and 180 degrees", d.Camera.FOV)
+	case d.Light.Direction == zeroVec && d.GLTF == "":
+		return errors.New("light has no direction")
+	}
+	for i, mesh := range d.Meshes {
+		if mesh.File == "" {
+			return fmt.Errorf("mesh %d has no file", i)
+		}
+		if err := mesh.Texture.validate(); err != nil {
+			return fmt.Errorf("mesh %d: %v", i, err)
+		}
+		if mesh.Texture != nil && mesh.Texture.Space != "" {
+			return fmt.Errorf("mesh %d: mesh textures have no space, they see the coordinates of the mesh", i)
+		}
+		if mesh.Crease != nil && *mesh.Crease < 0 {
+			return fmt.Errorf("mesh %d crease angle is negative", i)
+		}
+		if _, ok := cullModes[mesh.Cull]; !ok {
+			return fmt.Errorf("mesh %d: unknown cull mode %q", i, mesh.Cull)
+		}
+		if mesh.Transform != nil {
+			if err := mesh.Transform.validate(); err != nil {
+				return fmt.Errorf("mesh %d transform: %v", i, err)
+			}
+		}
+		for j, t := range mesh.Instances {
+			if err := t.validate(); err != nil {
+				return fmt.Errorf("mesh %d instance %d: %v", i, j, err)
+			}
+		}
+	}
+	for i, s := range d.Spheres {
+		if err := s.Texture.validate(); err != nil {
+			return fmt.Errorf("sphere %d: %v", i, err)
+		}
+	}
+	for i, p := range d.Planes {
+		if err := p.Texture.validate(); err != nil {
+			return fmt.Errorf("plane %d: %v", i, err)
+		}
+		if _, ok := cullModes[p.Cull]; !ok {
+			return fmt.Errorf("plane %d: unknown cull mode %q", i, p.Cull)
+		}
+	}
+	return nil
+}
+
+func (t *TransformDescription) validate() error {
+	if t.Angle != 0 && t.Axis == zeroVec {
+		return errors.New("rotation has no axis")
+	}
+	if t.matrix().Determinant() == 0 {
+		return errors.New("transform isn't invertible")
+	}
+	return nil
+}
+
+// matrix returns the object-to-world matrix of the transform
+func (t *TransformDescription) matrix() Matrix {
+	m := Identity()
+	if t.Scale != nil {
+		m = m.Scale(*t.Scale)
+	}
+	if t.Angle != 0 {
+		m = m.Rotate(t.Axis, t.Angle*math.Pi/180)
+	}
+	return m.Translate(t.Translate)
+}
+
+// maxOctaves bounds the octaves of noise textures, which are summed for every shaded sample. The
+// last is 65536 times finer than the first.
+const maxOctaves = 16
+
+var cullModes = map[string]Culling{"": CullBack, "none": CullNone, "back": CullBack, "front": CullFront}
+
+var wrapModes = map[string]WrapMode{"": WrapRepeat, "repeat": WrapRepeat, "clamp": WrapClamp, "mirror": WrapMirror}
+
+var filterModes = map[string]FilterMode{"": FilterEWA, "ewa": FilterEWA, "trilinear": FilterTrilinear, "bilinear": FilterBilinear}
+
+func (t *TextureDescription) validate() error {
+	if t == nil {
+		return nil
+	}
+	switch t.Type {
+	case "checker", "checker3d", "noise", "fbm", "turbulence", "marble", "wood":
+	case "image":
+		if t.File == "" {
+			return errors.New("image texture has no file")
+		}
+	default:
+		return fmt.Errorf("unknown texture type %q", t.Type)
+	}
+	if _, ok := wrapModes[t.Wrap]; !ok {
+		return fmt.Errorf("unknown texture wrap mode %q", t.Wrap)
+	}
+	if _, ok := filterModes[t.Filter]; !ok {
+		return fmt.Errorf("unknown texture filter %q", t.Filter)
+	}
+	if t.Space != "" && t.Space != "world" && t.Space != "object" {
+		return fmt.Errorf("unknown texture space %q", t.Space)
+	}
+	if t.Scale < 0 || t.Octaves < 0 {
+		return errors.New("texture scale and octaves can't be negative")
+	}
+	if t.Octaves > maxOctaves {
+		return fmt.Errorf("texture octaves must be at most %d", maxOctaves)
+	}
+	return nil
+}
+
+// Build creates the texture, loading images relative to dir. A nil description builds no texture.
+func (t *TextureDescription) Build(dir string) (Texture, TextureSpace, error) {
+	if t == nil {
+		return nil, WorldSpace, nil
+	}
+	space := WorldSpace
+	if t.Space == "object" {
+		space = ObjectSpace
+	}
+	scale, octaves, turb := t.Scale, t.Octaves, t.Turbulence
+	if scale == 0 {
+		scale = 1
+	}
+	if octaves == 0 {
+		octaves = 4
+	}
+	a, b := t.Colors[0], t.Colors[1]
+	switch t.Type {
+	case "checker":
+		return Checker{a, b, scale}, space, nil
+	case "checker3d":
+		return Checker3D{a, b, scale}, space, nil
+	case "noise":
+		return NoiseTexture{a, b, scale, 1, NoisePerlin}, space, nil
+	case "fbm":
+		return NoiseTexture{a, b, scale, octaves, NoiseFBM}, space, nil
+	case "turbulence":
+		return NoiseTexture{a, b, scale, octaves, NoiseTurbulence}, space, nil
+	case "marble":
+		if turb == 0 {
+			turb = 5
+		}
+		return Marble{a, b, scale, turb, octaves}, space, nil
+	case "wood":
+		if turb == 0 {
+			turb = 0.5
+		}
+		return Wood{a, b, scale, turb, octaves}, space, nil
+	}
+	path := t.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	img, err := LoadImageTexture(path, true)
+	if err != nil {
+		return nil, space, err
+	}
+	// Texture coordinates are scaled so Scale is the size of one copy of the image
+	return TextureMap{Path: path, Scale: Vec3{1 / scale, 1 / scale, 1}, Wrap: wrapModes[t.Wrap],
+		Filter: filterModes[t.Filter], Image: img}, space, nil
+}
+
+// Build loads the meshes of the scene through cache, resolving relative paths against dir, and returns
+// the scene and its camera. Confined keeps the files the meshes name inside their own directories, for
+// scenes from untrusted sources.
+func (d *SceneDescription) Build(dir string, cache MeshCache, confined bool) (*Scene, *Camera, error) {
+	var geometry []Geometry
+	for _, m := range d.Meshes {
+		path := m.File
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		bake := BakeOptions{Recentre: m.Recentre, Normalise: m.Normalise, FlipWinding: m.Flip}
+		if m.Transform != nil {
+			matrix := m.Transform.matrix()
+			bake.Matrix = &matrix
+		}
+		options := OBJOptions{m.Strict, defaultCreaseAngle, confined}
+		if m.Crease != nil {
+			options.CreaseAngle = *m.Crease
+		}
+		mesh, err := cache.Open(path, options, bake)
+		if err != nil {
+			return nil, nil, err
+		}
+		// validate refuses a space, mesh textures always see the mesh's own coordinates
+		if mesh.texture, _, err = m.Texture.Build(dir); err != nil {
+			return nil, nil, err
+		}
+		mesh.culling = cullModes[m.Cull]
+		if m.Instances == nil {
+			geometry = append(geometry, mesh)
+		}
+		for _, t := range m.Instances {
+			geometry = append(geometry, newInstance(mesh, t.matrix()))
+		}
+	}
+	for _, s := range d.Spheres {
+		texture, space, err := s.Texture.Build(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		geometry = append(geometry, &Sphere{center: s.Center, radius: s.Radius, color: s.Color, texture: texture, space: space})
+	}
+	for _, p := range d.Planes {
+		texture, space, err := p.Texture.Build(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Unlike meshes, planes are double-sided unless told otherwise
+		culling := cullModes[p.Cull]
+		if p.Cull == "" {
+			culling = CullNone
+		}
+		geometry = append(geometry, &Plane{p.Point, p.Normal.Normalize(), p.Color, texture, space, culling})
+	}
+	light := Light{d.Light.Direction.Normalize(), d.Light.Intensity}
+	fov := d.Camera.FOV
+	if d.GLTF != "" {
+		path := d.GLTF
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		g, err := OpenGLTF(path, fov)
+		if err != nil {
+			return nil, nil, err
+		}
+		geometry = append(geometry, g.Mesh)
+		fov = g.FOV
+		if g.Light.direction != zeroVec {
+			light = g.Light
+		} else if d.Light.Direction == zeroVec {
+			light = Light{defaultScene().Light.Direction.Normalize(), defaultScene().Light.Intensity}
+		}
+	}
+	camera := Camera{}
+	camera.Init(d.Camera.Eye, d.Width, d.Height)
+	camera.SetFOV(fov)
+	return &Scene{light, geometry}, &camera, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// defaultTileSize is the width and height of a tile in pixels
+const defaultTileSize = 32
+
+// minSplitSize is the smallest tile side a tile is split down to
+const minSplitSize = 4
+
+// TileOrder is the order tiles are handed to workers in
+type TileOrder string
+
+const (
+	// OrderScanline renders tiles left to right, top to bottom
+	OrderScanline TileOrder = "scanline"
+	// OrderSpiral renders tiles in rings spiralling out from the centre of the image
+	OrderSpiral TileOrder = "spiral"
+	// OrderHilbert renders tiles along a Hilbert curve, keeping consecutive tiles next to each other
+	OrderHilbert TileOrder = "hilbert"
+)
+
+// ParseTileOrder returns the TileOrder called name
+func ParseTileOrder(name string) (TileOrder, error) {
+	switch order := TileOrder(name); order {
+	case OrderScanline, OrderSpiral, OrderHilbert:
+		return order, nil
+	}
+	return "", fmt.Errorf("unknown tile order %q, expected scanline, spiral or hilbert", name)
+}
+
+// makeTiles splits a w by h image into size by size tiles, with partial tiles along the right and
+// bottom edges, sorted in the given order
+func makeTiles(w, h, size int, order TileOrder) []rect {
+	cols := (w + size - 1) / size
+	rows := (h + size - 1) / size
+	tiles := make([]rect, 0, cols*rows)
+	keys := make([]float64, 0, cols*rows)
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			left, top := col*size, row*size
+			tiles = append(tiles, rect{left, minInt(left+size, w), top, minInt(top+size, h)})
+			keys = append(keys, tileKey(order, col, row, cols, rows))
+		}
+	}
+	sort.Stable(tilesByKey{tiles, keys})
+	return tiles
+}
+
+// tileKey returns the position of the tile at (col, row) in order
+func tileKey(order TileOrder, col, row, cols, rows int) float64 {
+	switch order {
+	case OrderSpiral:
+		// Rings are squares around the centre, and each ring is walked clockwise from the top
+		dx := float64(col) + 0.5 - float64(cols)/2
+		dy := float64(row) + 0.5 - float64(rows)/2
+		ring := math.Floor(math.Max(math.Abs(dx), math.Abs(dy)))
+		angle := math.Atan2(dx, -dy)
+		if angle < 0 {
+			angle += 2 * math.Pi
+		}
+		return ring*8 + angle
+	case OrderHilbert:
+		n := 1
+		for n < cols || n < rows {
+			n *= 2
+		}
+		return float64(hilbertIndex(n, col, row))
+	}
+	return float64(row*cols + col)
+}
+
+// hilbertIndex returns the distance along a Hilbert curve filling an n by n grid, n a power of two,
+// to the cell (x, y)
+func hilbertIndex(n, x, y int) int {
+	d := 0
+	for s := n / 2; s > 0; s /= 2 {
+		rx, ry := 0, 0
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// Rotate the quadrant so the curve inside it starts and ends in the right place
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+type tilesByKey struct {
+	tiles []rect
+	keys  []float64
+}
+
+func (t tilesByKey) Len() int           { return len(t.tiles) }
+func (t tilesByKey) Less(i, j int) bool { return t.keys[i] < t.keys[j] }
+func (t tilesByKey) Swap(i, j int) {
+	t.tiles[i], t.tiles[j] = t.tiles[j], t.tiles[i]
+	t.keys[i], t.keys[j] = t.keys[j], t.keys[i]
+}
+
+// split divides r into quarters, or halves if it is too narrow or too short, or returns r unsplit
+func (r rect) split() []rect {
+	w, h := r.right-r.left, r.bottom-r.top
+	var xs, ys []int
+	xs = append(xs, r.left)
+	if w >= 2*minSplitSize {
+		xs = append(xs, r.left+w/2)
+	}
+	xs = append(xs, r.right)
+	ys = append(ys, r.top)
+	if h >= 2*minSplitSize {
+		ys = append(ys, r.top+h/2)
+	}
+	ys = append(ys, r.bottom)
+	parts := make([]rect, 0, 4)
+	for j := 0; j+1 < len(ys); j++ {
+		for i := 0; i+1 < len(xs); i++ {
+			parts = append(parts, rect{xs[i], xs[i+1], ys[j], ys[j+1]})
+		}
+	}
+	return parts
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
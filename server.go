@@ -0,0 +1,512 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The render server API:
+//
+//	POST   /jobs                 submit a job, either a JSON scene description as the body, or a
+//	                             multipart form with the description in the "scene" field and the
+//	                             OBJ files it refers to as file uploads
+//	GET    /jobs                 list the status of every job
+//	GET    /jobs/{id}            the status of a job
+//	DELETE /jobs/{id}            cancel a queued or running job, or forget a finished one
+//	GET    /jobs/{id}/image      the rendered PNG, once the job is done
+//	GET    /jobs/{id}/aov/{name} an AOV as a PNG: albedo, normal, depth or samples
+//
+// Finished jobs are forgotten after jobRetention, or sooner once more than maxFinishedJobs have finished.
+
+// maxQueuedJobs is how many jobs may wait to be rendered before submissions are refused
+const maxQueuedJobs = 64
+
+// maxUploadMemory is how much of an upload is kept in memory, the rest is spooled to disk
+const maxUploadMemory = 32 << 20
+
+// maxUploadSize bounds the body of a submission, scene and assets together
+const maxUploadSize = 1 << 30
+
+// Finished jobs are kept for jobRetention so their results can be fetched, and no more than
+// maxFinishedJobs of them, the oldest being forgotten first
+const (
+	jobRetention    = 24 * time.Hour
+	maxFinishedJobs = 256
+)
+
+// errQueueFull is returned by Submit when maxQueuedJobs are already waiting
+var errQueueFull = errors.New("too many queued jobs")
+
+// JobState is the state of a render job
+type JobState string
+
+const (
+	// JobQueued jobs are waiting for a free job runner
+	JobQueued JobState = "queued"
+	// JobRunning jobs are being rendered
+	JobRunning JobState = "running"
+	// JobDone jobs have an image
+	JobDone JobState = "done"
+	// JobFailed jobs couldn't be rendered, their status has the error
+	JobFailed JobState = "failed"
+	// JobCancelled jobs were cancelled before they finished
+	JobCancelled JobState = "cancelled"
+)
+
+// JobStatus reports the state of a job
+type JobStatus struct {
+	ID       string     `json:"id"`
+	State    JobState   `json:"state"`
+	Progress float64    `json:"progress"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Image and AOVs are the URLs of the results, once the job is done
+	Image string            `json:"image,omitempty"`
+	AOVs  map[string]string `json:"aovs,omitempty"`
+}
+
+// RenderJob is a scene waiting for, or going through, the renderer
+type RenderJob struct {
+	id   string
+	desc *SceneDescription
+	// dir holds the uploaded assets until the scene is built
+	dir string
+
+	mu    sync.Mutex
+	state JobState
+	err   error
+	// renderer is the job's renderer while it runs
+	renderer *Renderer
+	// results holds the images of a done job by AOV name, "" for the render itself
+	results                    map[string]image.Image
+	created, started, finished time.Time
+}
+
+// Status returns the current status of the job
+func (job *RenderJob) Status() JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := JobStatus{ID: job.id, State: job.state, Created: job.created}
+	if !job.started.IsZero() {
+		started := job.started
+		status.Started = &started
+	}
+	if !job.finished.IsZero() {
+		finished := job.finished
+		status.Finished = &finished
+	}
+	if job.err != nil {
+		status.Error = job.err.Error()
+	}
+	switch {
+	case job.state == JobDone:
+		status.Progress = 1
+		status.Image = "/jobs/" + job.id + "/image"
+		status.AOVs = make(map[string]string)
+		for _, name := range AOVNames {
+			status.AOVs[name] = "/jobs/" + job.id + "/aov/" + name
+		}
+		status.AOVs["samples"] = "/jobs/" + job.id + "/aov/samples"
+	case job.renderer != nil:
+		_, _, status.Progress = job.renderer.Progress()
+	}
+	return status
+}
+
+// RenderServer renders jobs submitted over HTTP. Jobs wait in a queue for one of a fixed number
+// of job runners, and the running jobs share one pool of tile workers.
+type RenderServer struct {
+	pool  *WorkerPool
+	queue chan *RenderJob
+	cache MeshCache
+
+	mu     sync.Mutex
+	jobs   map[string]*RenderJob
+	nextID int
+}
+
+func newRenderServer(workers, runners int, cache MeshCache) *RenderServer {
+	s := &RenderServer{pool: newWorkerPool(workers), queue: make(chan *RenderJob, maxQueuedJobs), cache: cache,
+		jobs: make(map[string]*RenderJob)}
+	for i := 0; i < runners; i++ {
+		go s.runJobs()
+	}
+	return s
+}
+
+func (s *RenderServer) runJobs() {
+	for job := range s.queue {
+		s.run(job)
+	}
+}
+
+func (s *RenderServer) run(job *RenderJob) {
+	defer func() {
+		if err := os.RemoveAll(job.dir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	job.mu.Lock()
+	if job.state != JobQueued {
+		job.mu.Unlock()
+		return
+	}
+	job.state = JobRunning
+	job.started = time.Now()
+	job.mu.Unlock()
+
+	// Scenes are uploaded by anyone, so their meshes can't name files outside the job's directory
+	scene, camera, err := job.desc.Build(job.dir, s.cache, true)
+	if err != nil {
+		job.finish(JobFailed, err, nil)
+		return
+	}
+	w, h := job.desc.Width, job.desc.Height
+	renderer := newRenderer(scene, camera, w, h)
+	renderer.pool = s.pool
+	renderer.aov = newAOVBuffers(w, h)
+	job.mu.Lock()
+	job.renderer = renderer
+	cancelled := job.state == JobCancelled
+	job.mu.Unlock()
+	if cancelled {
+		job.finish(JobCancelled, nil, nil)
+		return
+	}
+	renderer.RenderPass(makeTiles(w, h, defaultTileSize, OrderSpiral), job.desc.Samples, 0, nil)
+	if renderer.Cancelled() {
+		job.finish(JobCancelled, nil, nil)
+		return
+	}
+	results := map[string]image.Image{"": renderer.CreateImage(), "samples": renderer.fb.SampleHeatmap()}
+	for _, name := range AOVNames {
+		results[name] = renderer.aov.Image(name)
+	}
+	job.finish(JobDone, nil, results)
+}
+
+// finish ends a job in state, keeping the results of a done job, and drops its renderer with the
+// buffers it holds. A job cancelled before it got here stays cancelled.
+func (job *RenderJob) finish(state JobState, err error, results map[string]image.Image) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.state != JobCancelled {
+		job.state = state
+		job.err = err
+		job.results = results
+	}
+	job.renderer = nil
+	job.finished = time.Now()
+}
+
+// Cancel stops a queued or running job, it returns false if the job had already finished
+func (job *RenderJob) Cancel() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	switch job.state {
+	case JobQueued:
+		job.state = JobCancelled
+		job.finished = time.Now()
+	case JobRunning:
+		job.state = JobCancelled
+		if job.renderer != nil {
+			job.renderer.Cancel()
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// Submit queues a scene whose assets have been saved in dir
+func (s *RenderServer) Submit(desc *SceneDescription, dir string) (*RenderJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	job := &RenderJob{id: strconv.Itoa(s.nextID), desc: desc, dir: dir, state: JobQueued, created: time.Now()}
+	select {
+	case s.queue <- job:
+	default:
+		return nil, errQueueFull
+	}
+	s.evictFinished(job.created)
+	s.jobs[job.id] = job
+	return job, nil
+}
+
+// evictFinished forgets the jobs that finished more than jobRetention before now, and the oldest
+// finished jobs beyond maxFinishedJobs. s.mu must be held.
+func (s *RenderServer) evictFinished(now time.Time) {
+	type finishedJob struct {
+		id string
+		at time.Time
+	}
+	var finished []finishedJob
+	for id, job := range s.jobs {
+		job.mu.Lock()
+		at := job.finished
+		job.mu.Unlock()
+		switch {
+		case at.IsZero():
+		case now.Sub(at) > jobRetention:
+			delete(s.jobs, id)
+		default:
+			finished = append(finished, finishedJob{id, at})
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].at.Before(finished[j].at) })
+	for _, job := range finished[:len(finished)-maxFinishedJobs] {
+		delete(s.jobs, job.id)
+	}
+}
+
+func (s *RenderServer) job(id string) *RenderJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.jobs[id]
+}
+
+func (s *RenderServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "jobs" {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		s.handleSubmit(w, r)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.handleList(w)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		if job := s.findJob(w, r, parts[1]); job != nil {
+			writeJSON(w, http.StatusOK, job.Status())
+		}
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		s.handleCancel(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "image" && r.Method == http.MethodGet:
+		s.handleResult(w, r, parts[1], "")
+	case len(parts) == 4 && parts[2] == "aov" && r.Method == http.MethodGet:
+		s.handleResult(w, r, parts[1], parts[3])
+	default:
+		http.Error(w, "unknown request", http.StatusNotFound)
+	}
+}
+
+func (s *RenderServer) findJob(w http.ResponseWriter, r *http.Request, id string) *RenderJob {
+	job := s.job(id)
+	if job == nil {
+		http.Error(w, "no job "+id, http.StatusNotFound)
+	}
+	return job
+}
+
+func (s *RenderServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	dir, err := os.MkdirTemp("", "goray-job-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	desc, err := readSubmission(r, dir)
+	if err == nil {
+		var job *RenderJob
+		if job, err = s.Submit(desc, dir); err == nil {
+			w.Header().Set("Location", "/jobs/"+job.id)
+			writeJSON(w, http.StatusAccepted, job.Status())
+			return
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == errQueueFull:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.As(err, &tooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// readSubmission reads the scene description of a submitted job and saves its assets in dir
+func readSubmission(r *http.Request, dir string) (*SceneDescription, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return checkAssets(data, dir)
+	}
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := r.MultipartForm.RemoveAll(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	for _, files := range r.MultipartForm.File {
+		for _, header := range files {
+			if err := saveAsset(header, dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return checkAssets([]byte(r.FormValue("scene")), dir)
+}
+
+// checkAssets parses a scene description and checks that every file it refers to was uploaded
+func checkAssets(data []byte, dir string) (*SceneDescription, error) {
+	desc, err := ParseSceneDescription(data)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	var textures []*TextureDescription
+	for _, mesh := range desc.Meshes {
+		files = append(files, mesh.File)
+		textures = append(textures, mesh.Texture)
+	}
+	for _, s := range desc.Spheres {
+		textures = append(textures, s.Texture)
+	}
+	for _, p := range desc.Planes {
+		textures = append(textures, p.Texture)
+	}
+	for _, t := range textures {
+		if t != nil && t.Type == "image" {
+			files = append(files, t.File)
+		}
+	}
+	if desc.GLTF != "" {
+		files = append(files, desc.GLTF)
+	}
+	for _, file := range files {
+		if filepath.Base(file) != file {
+			return nil, fmt.Errorf("file %q must be the name of an uploaded file", file)
+		}
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			return nil, fmt.Errorf("file %q wasn't uploaded", file)
+		}
+	}
+	return desc, nil
+}
+
+func saveAsset(header *multipart.FileHeader, dir string) (err error) {
+	name := filepath.Base(header.Filename)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name %q", header.Filename)
+	}
+	in, err := header.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	_, err = io.Copy(out, in)
+	return err
+}
+
+func (s *RenderServer) handleList(w http.ResponseWriter) {
+	s.mu.Lock()
+	jobs := make([]*RenderJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].created.Before(jobs[j].created) })
+	statuses := make([]JobStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = job.Status()
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *RenderServer) handleCancel(w http.ResponseWriter, r *http.Request, id string) {
+	job := s.findJob(w, r, id)
+	if job == nil {
+		return
+	}
+	if !job.Cancel() {
+		// The job had already finished, so forget it and free its results
+		s.mu.Lock()
+		delete(s.jobs, id)
+		s.mu.Unlock()
+	}
+	writeJSON(w, http.StatusOK, job.Status())
+}
+
+func (s *RenderServer) handleResult(w http.ResponseWriter, r *http.Request, id, aov string) {
+	job := s.findJob(w, r, id)
+	if job == nil {
+		return
+	}
+	job.mu.Lock()
+	state, result := job.state, job.results[aov]
+	job.mu.Unlock()
+	if state != JobDone {
+		http.Error(w, "job "+id+" is "+string(state), http.StatusConflict)
+		return
+	}
+	if result == nil {
+		http.Error(w, "no AOV "+aov, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, result); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
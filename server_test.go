@@ -0,0 +1,65 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"image"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestCancelBeforeFinish checks that a job cancelled after its pass, but before it finished, stays
+// cancelled and drops its renderer
+func TestCancelBeforeFinish(t *testing.T) {
+	job := &RenderJob{id: "1", state: JobRunning, renderer: newRenderer(&Scene{}, &Camera{}, 1, 1)}
+	if !job.Cancel() {
+		t.Fatal("a running job couldn't be cancelled")
+	}
+	job.finish(JobDone, nil, map[string]image.Image{"": image.NewRGBA(image.Rect(0, 0, 1, 1))})
+	if status := job.Status(); status.State != JobCancelled || status.Image != "" {
+		t.Errorf("the cancelled job finished as %s with image %q", status.State, status.Image)
+	}
+	if job.renderer != nil || job.results != nil {
+		t.Error("the cancelled job kept its renderer or results")
+	}
+}
+
+// TestEvictFinished checks that finished jobs are forgotten once they're too old or too many, and that
+// unfinished ones are kept
+func TestEvictFinished(t *testing.T) {
+	now := time.Now()
+	s := &RenderServer{jobs: make(map[string]*RenderJob)}
+	add := func(id string, state JobState, finished time.Time) {
+		s.jobs[id] = &RenderJob{id: id, state: state, finished: finished}
+	}
+	add("old", JobDone, now.Add(-jobRetention-time.Minute))
+	add("running", JobRunning, time.Time{})
+	for i := 0; i < maxFinishedJobs+2; i++ {
+		add(strconv.Itoa(i), JobDone, now.Add(time.Duration(i-maxFinishedJobs-2)*time.Second))
+	}
+	s.evictFinished(now)
+	for _, id := range []string{"old", "0", "1"} {
+		if s.jobs[id] != nil {
+			t.Errorf("job %s wasn't evicted", id)
+		}
+	}
+	if s.jobs["running"] == nil || s.jobs["2"] == nil || len(s.jobs) != maxFinishedJobs+1 {
+		t.Errorf("%d jobs are left, want the running one and the %d newest", len(s.jobs), maxFinishedJobs)
+	}
+}
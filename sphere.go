@@ -28,6 +28,9 @@ type Sphere struct {
 	color        Vec3
 	transparency float64
 	reflection   float64
+	// texture, when set, replaces color
+	texture Texture
+	space   TextureSpace
 }
 
 // Color returns the color of a triangle
@@ -35,6 +38,21 @@ func (s *Sphere) Color() Vec3 {
 	return s.color
 }
 
+// ColorAt returns the color of the sphere at a hit. Textures get the latitude and longitude of the
+// hit as texture coordinates, and points relative to the centre in object space.
+func (s *Sphere) ColorAt(hit Hit) Vec3 {
+	if s.texture == nil {
+		return s.color
+	}
+	local := hit.Point.Sub(s.center)
+	d := local.Mul(1 / s.radius)
+	uv := Vec3{0.5 + math.Atan2(d.Z, d.X)/(2*math.Pi), 0.5 + math.Asin(clamp(d.Y, -1, 1))/math.Pi, 0}
+	if s.space == WorldSpace {
+		return s.texture.At(hit.Point, uv)
+	}
+	return s.texture.At(local, uv)
+}
+
 func (s *Sphere) isTransparent() bool {
 	return s.transparency > 0
 }
@@ -98,5 +116,5 @@ func (s *Sphere) IntersectHit(r Ray) Hit {
 
 	intersection := r.Origin.Add(r.Direction.Mul(t))
 	n := intersection.Sub(s.center).Normalize()
-	return Hit{t, intersection, n}
+	return Hit{t, intersection, n, zeroVec, nil, nil, 0, nil, zeroVec, zeroVec}
 }
@@ -0,0 +1,161 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// stlHeaderSize is the size of the header of a binary STL file, up to the triangle count
+const stlHeaderSize = 84
+
+// stlTriangleSize is the size of a triangle in a binary STL file: a normal, three vertices and an
+// attribute byte count
+const stlTriangleSize = 50
+
+// OpenSTL reads the mesh of an STL file, ASCII or binary. The normals in the file are ignored in
+// favour of faceted normals from the order of the vertices, and degenerate triangles are dropped.
+func OpenSTL(path string) (*Mesh, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	return ParseSTL(file, path)
+}
+
+// ParseSTL reads an STL file from r, prefixing errors with path. A file is binary if its size matches
+// its triangle count, since binary headers may start with "solid" too.
+func ParseSTL(r io.Reader, path string) (*Mesh, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var triangles [][3]Vec3
+	if len(data) >= stlHeaderSize &&
+		uint64(len(data)) == stlHeaderSize+stlTriangleSize*uint64(binary.LittleEndian.Uint32(data[80:])) {
+		triangles = parseBinarySTL(data)
+	} else if bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("solid")) {
+		if triangles, err = parseASCIISTL(data, path); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, fmt.Errorf("%s: not an STL file, or a truncated binary one", path)
+	}
+	// STL files don't share vertices between triangles. Faces have no normals, so they're flat.
+	m := newMesh()
+	for _, t := range triangles {
+		if crossProduct(t[1].Sub(t[0]), t[2].Sub(t[0])) != zeroVec && finite(t[0]) && finite(t[1]) && finite(t[2]) {
+			v := uint32(len(m.positions))
+			m.positions = append(m.positions, t[:]...)
+			m.faces = append(m.faces, meshFace{V: [3]uint32{v, v + 1, v + 2}})
+		}
+	}
+	if dropped := len(triangles) - len(m.faces); dropped > 0 {
+		fmt.Fprintf(os.Stderr, "%s: dropped %d degenerate triangles\n", path, dropped)
+	}
+	if len(m.faces) == 0 {
+		return nil, fmt.Errorf("%s: no triangles", path)
+	}
+	m.finish()
+	return m, nil
+}
+
+func parseBinarySTL(data []byte) [][3]Vec3 {
+	count := int(binary.LittleEndian.Uint32(data[80:]))
+	triangles := make([][3]Vec3, count)
+	for i := range triangles {
+		b := data[stlHeaderSize+i*stlTriangleSize:]
+		var v [4]Vec3
+		for j := range v {
+			v[j] = Vec3{stlFloat(b[12*j:]), stlFloat(b[12*j+4:]), stlFloat(b[12*j+8:])}
+		}
+		// v[0] is the normal
+		triangles[i] = [3]Vec3{v[1], v[2], v[3]}
+	}
+	return triangles
+}
+
+func stlFloat(b []byte) float64 {
+	return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+}
+
+// parseASCIISTL reads the facets of one or more solids
+func parseASCIISTL(data []byte, path string) ([][3]Vec3, error) {
+	var triangles [][3]Vec3
+	var vertices []Vec3
+	// expect is the keyword each state of a facet is waiting for
+	expect := "solid"
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", path, line, fmt.Sprintf(format, args...))
+		}
+		switch {
+		case keyword == "solid" && expect == "solid":
+			expect = "facet"
+		case keyword == "endsolid" && expect == "facet":
+			expect = "solid"
+		case keyword == "facet" && expect == "facet":
+			// The normal is recomputed from the vertices
+			expect = "outer"
+		case keyword == "outer" && expect == "outer":
+			vertices = vertices[:0]
+			expect = "vertex"
+		case keyword == "vertex" && expect == "vertex":
+			v, err := parseOBJVector(fields[1:], 3, 3)
+			if err != nil {
+				return nil, fail("vertex: %v", err)
+			}
+			vertices = append(vertices, v)
+			if len(vertices) == 3 {
+				expect = "endloop"
+			}
+		case keyword == "endloop" && expect == "endloop":
+			expect = "endfacet"
+		case keyword == "endfacet" && expect == "endfacet":
+			triangles = append(triangles, [3]Vec3{vertices[0], vertices[1], vertices[2]})
+			expect = "facet"
+		default:
+			return nil, fail("expected %s, got %s", expect, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	// A missing endsolid is forgiven, a facet cut short is not
+	if expect != "solid" && expect != "facet" {
+		return nil, fmt.Errorf("%s: unexpected end of file, expected %s", path, expect)
+	}
+	return triangles, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// STLFormat is the encoding WriteSTL writes
+type STLFormat int
+
+const (
+	// STLBinary is the compact binary encoding, storing coordinates as float32
+	STLBinary STLFormat = iota
+	// STLASCII is the text encoding, keeping coordinates at full precision
+	STLASCII
+)
+
+// WriteSTL writes the triangles of meshes, transformed by transform, as an STL solid called name.
+// Normals are those of the transformed faces, and the vertices of each face are reordered when the
+// transform mirrors the mesh, so faces keep facing outwards.
+func WriteSTL(w io.Writer, name string, meshes []*Mesh, transform Matrix, format STLFormat) error {
+	parts := make([]stlPart, len(meshes))
+	for i, m := range meshes {
+		parts[i] = stlPart{m, transform}
+	}
+	return writeSTLParts(w, name, parts, format)
+}
+
+// stlPart is a mesh written to an STL file and its transform
+type stlPart struct {
+	mesh      *Mesh
+	transform Matrix
+}
+
+// writeSTLParts writes the triangles of parts like WriteSTL, each with its own transform
+func writeSTLParts(w io.Writer, name string, parts []stlPart, format STLFormat) error {
+	count := 0
+	for _, part := range parts {
+		count += len(part.mesh.faces)
+	}
+	if count > math.MaxUint32 {
+		return fmt.Errorf("%d triangles are too many for an STL file", count)
+	}
+	bw := bufio.NewWriter(w)
+	if format == STLASCII {
+		fmt.Fprintf(bw, "solid %s\n", name)
+	} else {
+		var header [stlHeaderSize]byte
+		copy(header[:80], "binary STL "+name)
+		binary.LittleEndian.PutUint32(header[80:], uint32(count))
+		bw.Write(header[:])
+	}
+	var buf [stlTriangleSize]byte
+	for _, part := range parts {
+		m, transform := part.mesh, part.transform
+		mirrored := transform.Determinant() < 0
+		for _, f := range m.faces {
+			v1, v2, v3 := transform.MulPoint(m.positions[f.V[0]]), transform.MulPoint(m.positions[f.V[1]]),
+				transform.MulPoint(m.positions[f.V[2]])
+			if mirrored {
+				v2, v3 = v3, v2
+			}
+			n := crossProduct(v2.Sub(v1), v3.Sub(v1))
+			if n != zeroVec {
+				n = n.Normalize()
+			}
+			if format == STLASCII {
+				fmt.Fprintf(bw, "facet normal %s\nouter loop\n", stlVector(n))
+				for _, v := range []Vec3{v1, v2, v3} {
+					fmt.Fprintf(bw, "vertex %s\n", stlVector(v))
+				}
+				fmt.Fprint(bw, "endloop\nendfacet\n")
+				continue
+			}
+			for i, v := range []Vec3{n, v1, v2, v3} {
+				binary.LittleEndian.PutUint32(buf[12*i:], math.Float32bits(float32(v.X)))
+				binary.LittleEndian.PutUint32(buf[12*i+4:], math.Float32bits(float32(v.Y)))
+				binary.LittleEndian.PutUint32(buf[12*i+8:], math.Float32bits(float32(v.Z)))
+			}
+			bw.Write(buf[:])
+		}
+	}
+	if format == STLASCII {
+		fmt.Fprintf(bw, "endsolid %s\n", name)
+	}
+	return bw.Flush()
+}
+
+// exportSTL writes the meshes of scene, and copies of them for their instances, to a binary STL file at path
+func exportSTL(path string, scene *Scene) (err error) {
+	var parts []stlPart
+	for _, object := range scene.geometry {
+		parts = appendSTLParts(parts, object, Identity())
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("the scene has no meshes to export")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	// If an error occurs during close, report it unless the write already failed
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return writeSTLParts(file, filepath.Base(path), parts, STLBinary)
+}
+
+// appendSTLParts appends the meshes of object placed by transform to parts
+func appendSTLParts(parts []stlPart, object Geometry, transform Matrix) []stlPart {
+	switch g := object.(type) {
+	case *Mesh:
+		parts = append(parts, stlPart{g, transform})
+	case *Instance:
+		parts = appendSTLParts(parts, g.Geometry, transform.Mul(g.toWorld))
+	}
+	return parts
+}
+
+// stlVector formats v with the fewest digits that read back as the same numbers
+func stlVector(v Vec3) string {
+	return strconv.FormatFloat(v.X, 'g', -1, 64) + " " + strconv.FormatFloat(v.Y, 'g', -1, 64) + " " +
+		strconv.FormatFloat(v.Z, 'g', -1, 64)
+}
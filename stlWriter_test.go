@@ -0,0 +1,80 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestWriteSTLRoundTrip writes the teapot in both encodings, plain and mirrored, and checks that
+// ParseSTL reads back every triangle in place and facing the way the transformed face does
+func TestWriteSTLRoundTrip(t *testing.T) {
+	teapot, err := OpenOBJ("teapot.obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transforms := map[string]Matrix{
+		"identity": Identity(),
+		"mirrored": Translate(Vec3{1, 2, 3}).Scale(Vec3{-2, 1, 1}),
+	}
+	formats := map[string]STLFormat{"binary": STLBinary, "ascii": STLASCII}
+	for transformName, transform := range transforms {
+		normalMatrix := transform.Inverse().Transpose()
+		mirrored := transform.Determinant() < 0
+		for formatName, format := range formats {
+			t.Run(formatName+" "+transformName, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := WriteSTL(&buf, "teapot", []*Mesh{teapot}, transform, format); err != nil {
+					t.Fatal(err)
+				}
+				m, err := ParseSTL(&buf, "teapot.stl")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(m.faces) != len(teapot.faces) {
+					t.Fatalf("read %d triangles, wrote %d", len(m.faces), len(teapot.faces))
+				}
+				// Binary files store float32 coordinates
+				tolerance := 0.0
+				if format == STLBinary {
+					tolerance = 1e-5
+				}
+				for i, f := range teapot.faces {
+					want := [3]Vec3{transform.MulPoint(teapot.positions[f.V[0]]),
+						transform.MulPoint(teapot.positions[f.V[1]]), transform.MulPoint(teapot.positions[f.V[2]])}
+					if mirrored {
+						want[1], want[2] = want[2], want[1]
+					}
+					g := m.faces[i]
+					got := [3]Vec3{m.positions[g.V[0]], m.positions[g.V[1]], m.positions[g.V[2]]}
+					for j := range got {
+						if got[j].Distance(want[j]) > tolerance*(1+want[j].Magnitude()) {
+							t.Fatalf("triangle %d vertex %d is %v, want %v", i, j, got[j], want[j])
+						}
+					}
+					v := teapot.positions
+					normal := normalMatrix.MulDirection(crossProduct(v[f.V[1]].Sub(v[f.V[0]]), v[f.V[2]].Sub(v[f.V[0]])))
+					if dotProduct(crossProduct(got[1].Sub(got[0]), got[2].Sub(got[0])), normal) <= 0 {
+						t.Fatalf("triangle %d faces inwards", i)
+					}
+				}
+			})
+		}
+	}
+}
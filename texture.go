@@ -0,0 +1,349 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	"fmt"
+	"image"
+	// Register the formats image textures can be loaded from
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+)
+
+// Texture is a color that varies over a surface
+type Texture interface {
+	// At returns the color at point p, in world or object space, with texture coordinates uv
+	At(p, uv Vec3) Vec3
+}
+
+// TextureSpace selects the space the point passed to a Texture is in
+type TextureSpace int
+
+const (
+	// WorldSpace passes the hit point as it is
+	WorldSpace TextureSpace = iota
+	// ObjectSpace passes the hit point relative to the origin of the object, so the texture moves with it
+	ObjectSpace
+)
+
+// WrapMode says how texture coordinates outside [0, 1] are mapped into a texture
+type WrapMode int
+
+const (
+	// WrapRepeat tiles the texture
+	WrapRepeat WrapMode = iota
+	// WrapClamp stretches the edge texels
+	WrapClamp
+	// WrapMirror tiles the texture, flipping every other copy
+	WrapMirror
+)
+
+// FilterMode selects how an image texture is averaged over the footprint of a lookup
+type FilterMode int
+
+const (
+	// FilterEWA averages an elliptical footprint with Gaussian weights, keeping detail along the
+	// short axis of the ellipse at grazing angles
+	FilterEWA FilterMode = iota
+	// FilterTrilinear blends the two mipmap levels nearest the width of the footprint
+	FilterTrilinear
+	// FilterBilinear reads the full size image and ignores the footprint
+	FilterBilinear
+)
+
+// maxAnisotropy is the longest the major axis of an EWA footprint may be relative to its minor axis.
+// Longer footprints are widened, trading some blur for a bounded number of texels per lookup.
+const maxAnisotropy = 8
+
+// ewaAlpha is the falloff of the Gaussian weights of EWA filtering
+const ewaAlpha = 2
+
+// ImageTexture is an image stored as linear RGB, three float32s per texel with the top row first
+type ImageTexture struct {
+	Width, Height int
+	Pix           []float32
+	// mips holds the images halved in size down to 1x1, starting with the second level
+	mips []*ImageTexture
+}
+
+// newImageTexture converts img to linear RGB, decoding sRGB when srgb is set
+func newImageTexture(img image.Image, srgb bool) *ImageTexture {
+	b := img.Bounds()
+	t := &ImageTexture{b.Dx(), b.Dy(), make([]float32, 0, 3*b.Dx()*b.Dy()), nil}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			c := Vec3{float64(r), float64(g), float64(bl)}
+			// Undo the premultiplied alpha
+			if a > 0 {
+				c = c.Mul(1 / float64(a))
+			}
+			if srgb {
+				c.sRGBToLinear()
+			}
+			t.Pix = append(t.Pix, float32(c.X), float32(c.Y), float32(c.Z))
+		}
+	}
+	t.buildMips()
+	return t
+}
+
+// buildMips fills the mipmap pyramid. Each texel of a level is the box filtered average of the texels
+// of the level above it that it covers, two by two unless a side is odd.
+func (t *ImageTexture) buildMips() {
+	t.mips = nil
+	for level := t; level.Width > 1 || level.Height > 1; {
+		w, h := maxInt(1, level.Width/2), maxInt(1, level.Height/2)
+		next := &ImageTexture{w, h, make([]float32, 0, 3*w*h), nil}
+		for y := 0; y < h; y++ {
+			y0, y1 := y*level.Height/h, maxInt(y*level.Height/h+1, (y+1)*level.Height/h)
+			for x := 0; x < w; x++ {
+				x0, x1 := x*level.Width/w, maxInt(x*level.Width/w+1, (x+1)*level.Width/w)
+				var sum Vec3
+				for sy := y0; sy < y1; sy++ {
+					for sx := x0; sx < x1; sx++ {
+						sum = sum.Add(level.texel(sx, sy))
+					}
+				}
+				sum = sum.Mul(1 / float64((x1-x0)*(y1-y0)))
+				next.Pix = append(next.Pix, float32(sum.X), float32(sum.Y), float32(sum.Z))
+			}
+		}
+		t.mips = append(t.mips, next)
+		level = next
+	}
+}
+
+// Levels returns the number of mipmap levels, including the full size image
+func (t *ImageTexture) Levels() int {
+	return len(t.mips) + 1
+}
+
+// level returns mipmap level i, 0 being the full size image
+func (t *ImageTexture) level(i int) *ImageTexture {
+	if i <= 0 {
+		return t
+	}
+	return t.mips[minInt(i, len(t.mips))-1]
+}
+
+// lod returns the continuous mipmap level where a footprint width wide, in texture coordinates,
+// covers about one texel
+func (t *ImageTexture) lod(width float64) float64 {
+	if width <= 0 {
+		return 0
+	}
+	lod := math.Log2(width * float64(maxInt(t.Width, t.Height)))
+	return math.Max(0, math.Min(lod, float64(t.Levels()-1)))
+}
+
+// Trilinear returns the texture at (u, v) for a footprint width wide, interpolated between the two
+// nearest mipmap levels
+func (t *ImageTexture) Trilinear(u, v, width float64, wrap WrapMode) Vec3 {
+	lod := t.lod(width)
+	i := int(lod)
+	f := lod - float64(i)
+	c := t.level(i).Bilinear(u, v, wrap)
+	if f == 0 {
+		return c
+	}
+	return c.Mul(1 - f).Add(t.level(i+1).Bilinear(u, v, wrap).Mul(f))
+}
+
+// EWA returns the texture at (u, v) averaged over the ellipse with axes d0 and d1, in texture
+// coordinates, interpolated between the two mipmap levels nearest the length of the minor axis
+func (t *ImageTexture) EWA(u, v float64, d0, d1 Vec3, wrap WrapMode) Vec3 {
+	if d0.X*d0.X+d0.Y*d0.Y < d1.X*d1.X+d1.Y*d1.Y {
+		d0, d1 = d1, d0
+	}
+	major := math.Hypot(d0.X, d0.Y)
+	minor := math.Hypot(d1.X, d1.Y)
+	if minor*maxAnisotropy < major && minor > 0 {
+		scale := major / (minor * maxAnisotropy)
+		d1 = d1.Mul(scale)
+		minor *= scale
+	}
+	if minor == 0 {
+		return t.Bilinear(u, v, wrap)
+	}
+	lod := t.lod(minor)
+	i := int(lod)
+	f := lod - float64(i)
+	// The coarsest level is a single texel averaging the image, which a footprint covering the whole
+	// image filters to. Filtering it, or a tiling of it, texel by texel would take time growing with
+	// the footprint.
+	if i >= t.Levels()-1 {
+		return t.level(i).texel(0, 0)
+	}
+	c := t.level(i).ewa(u, v, d0, d1, wrap)
+	if f == 0 {
+		return c
+	}
+	return c.Mul(1 - f).Add(t.level(i+1).ewa(u, v, d0, d1, wrap).Mul(f))
+}
+
+// ewa filters a single level. The ellipse is widened by a texel so it always covers a few texels.
+func (t *ImageTexture) ewa(u, v float64, d0, d1 Vec3, wrap WrapMode) Vec3 {
+	w, h := float64(t.Width), float64(t.Height)
+	// In texels, with y running down the image
+	s, tt := u*w-0.5, (1-v)*h-0.5
+	ds0, dt0 := d0.X*w, -d0.Y*h
+	ds1, dt1 := d1.X*w, -d1.Y*h
+	a := dt0*dt0 + dt1*dt1 + 1
+	b := -2 * (ds0*dt0 + ds1*dt1)
+	c := ds0*ds0 + ds1*ds1 + 1
+	inv := 1 / (a*c - b*b/4)
+	a, b, c = a*inv, b*inv, c*inv
+	det := 4*a*c - b*b
+	su, sv := 2*math.Sqrt(det*c)/det, 2*math.Sqrt(det*a)/det
+	var sum Vec3
+	var weights float64
+	for y := math.Ceil(tt - sv); y <= math.Floor(tt+sv); y++ {
+		dy := y - tt
+		for x := math.Ceil(s - su); x <= math.Floor(s+su); x++ {
+			dx := x - s
+			r2 := a*dx*dx + b*dx*dy + c*dy*dy
+			if r2 >= 1 {
+				continue
+			}
+			weight := math.Exp(-ewaAlpha*r2) - math.Exp(-ewaAlpha)
+			sum = sum.Add(t.texel(wrapIndex(int(x), t.Width, wrap), wrapIndex(int(y), t.Height, wrap)).Mul(weight))
+			weights += weight
+		}
+	}
+	if weights <= 0 {
+		return t.Bilinear(u, v, wrap)
+	}
+	return sum.Mul(1 / weights)
+}
+
+// LoadImageTexture reads a PNG or JPEG file as a texture, srgb says whether it holds sRGB colors
+// or linear data
+func LoadImageTexture(path string, srgb bool) (*ImageTexture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if img.Bounds().Empty() {
+		return nil, fmt.Errorf("%s: empty image", path)
+	}
+	return newImageTexture(img, srgb), nil
+}
+
+func (t *ImageTexture) texel(x, y int) Vec3 {
+	i := 3 * (y*t.Width + x)
+	return Vec3{float64(t.Pix[i]), float64(t.Pix[i+1]), float64(t.Pix[i+2])}
+}
+
+// Bilinear returns the texture at (u, v) interpolated between the four nearest texels.
+// v runs up the image, as in OBJ files.
+func (t *ImageTexture) Bilinear(u, v float64, wrap WrapMode) Vec3 {
+	x := u*float64(t.Width) - 0.5
+	y := (1-v)*float64(t.Height) - 0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	xa, xb := wrapIndex(int(x0), t.Width, wrap), wrapIndex(int(x0)+1, t.Width, wrap)
+	ya, yb := wrapIndex(int(y0), t.Height, wrap), wrapIndex(int(y0)+1, t.Height, wrap)
+	top := t.texel(xa, ya).Mul(1 - fx).Add(t.texel(xb, ya).Mul(fx))
+	bottom := t.texel(xa, yb).Mul(1 - fx).Add(t.texel(xb, yb).Mul(fx))
+	return top.Mul(1 - fy).Add(bottom.Mul(fy))
+}
+
+// wrapIndex maps a texel index into [0, n)
+func wrapIndex(i, n int, wrap WrapMode) int {
+	switch wrap {
+	case WrapClamp:
+		if i < 0 {
+			return 0
+		}
+		if i >= n {
+			return n - 1
+		}
+		return i
+	case WrapMirror:
+		i %= 2 * n
+		if i < 0 {
+			i += 2 * n
+		}
+		if i >= n {
+			i = 2*n - 1 - i
+		}
+		return i
+	}
+	i %= n
+	if i < 0 {
+		i += n
+	}
+	return i
+}
+
+// At returns the image at uv, making a TextureMap usable as a Texture
+func (tm TextureMap) At(p, uv Vec3) Vec3 {
+	return tm.Sample(uv)
+}
+
+// Sample returns the texture of the map at the texture coordinates uv, after its scale and offset
+func (tm *TextureMap) Sample(uv Vec3) Vec3 {
+	return tm.Image.Bilinear(uv.X*tm.Scale.X+tm.Offset.X, uv.Y*tm.Scale.Y+tm.Offset.Y, tm.Wrap)
+}
+
+// bump returns the normal at a hit after displacing the surface, which moves by dpdu and dpdv along
+// the texture coordinates, by the heights of a bump map. Heights are the luminance of the map times
+// its Bump multiplier, and are differenced over the footprint of the hit, or a texel without one.
+func (tm *TextureMap) bump(hit Hit, dpdu, dpdv Vec3) Vec3 {
+	du := 0.5 * (math.Abs(hit.DUVDX.X) + math.Abs(hit.DUVDY.X))
+	if du == 0 {
+		du = 1 / (float64(tm.Image.Width) * math.Max(math.Abs(tm.Scale.X), 1e-9))
+	}
+	dv := 0.5 * (math.Abs(hit.DUVDX.Y) + math.Abs(hit.DUVDY.Y))
+	if dv == 0 {
+		dv = 1 / (float64(tm.Image.Height) * math.Max(math.Abs(tm.Scale.Y), 1e-9))
+	}
+	h := tm.Sample(hit.UV).luminance()
+	dhdu := (tm.Sample(hit.UV.Add(Vec3{du, 0, 0})).luminance() - h) / du * tm.Bump
+	dhdv := (tm.Sample(hit.UV.Add(Vec3{0, dv, 0})).luminance() - h) / dv * tm.Bump
+	// The change of the normal over the surface is ignored, as it is small next to that of the heights
+	n := crossProduct(dpdu.Add(hit.Normal.Mul(dhdu)), dpdv.Add(hit.Normal.Mul(dhdv))).Normalize()
+	if dotProduct(n, hit.Normal) < 0 {
+		n = n.Mul(-1)
+	}
+	return n
+}
+
+// Lookup returns the texture of the map at a hit, filtered over the footprint of the hit with the
+// map's filter. Hits without a footprint are read like Sample.
+func (tm *TextureMap) Lookup(hit Hit) Vec3 {
+	u, v := hit.UV.X*tm.Scale.X+tm.Offset.X, hit.UV.Y*tm.Scale.Y+tm.Offset.Y
+	d0 := Vec3{hit.DUVDX.X * tm.Scale.X, hit.DUVDX.Y * tm.Scale.Y, 0}
+	d1 := Vec3{hit.DUVDY.X * tm.Scale.X, hit.DUVDY.Y * tm.Scale.Y, 0}
+	switch tm.Filter {
+	case FilterBilinear:
+		return tm.Image.Bilinear(u, v, tm.Wrap)
+	case FilterTrilinear:
+		width := 2 * math.Max(math.Max(math.Abs(d0.X), math.Abs(d0.Y)), math.Max(math.Abs(d1.X), math.Abs(d1.Y)))
+		return tm.Image.Trilinear(u, v, width, tm.Wrap)
+	}
+	return tm.Image.EWA(u, v, d0, d1, tm.Wrap)
+}
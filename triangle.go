@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
 )
 
@@ -22,7 +23,8 @@ import (
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
-// Triangle stores relevant information for triangles
+// Triangle stores relevant information for triangles. Meshes store their faces as indices, and
+// look them up into a Triangle where the corners are needed together.
 type Triangle struct {
 	V1, V2, V3   Vec3
 	N1, N2, N3   Vec3
@@ -30,6 +32,8 @@ type Triangle struct {
 	color        Vec3
 	transparency float64
 	reflection   float64
+	// material is the triangle's material from the MTL file, nil to use the mesh color
+	material *Material
 }
 
 // Color returns the color of a triangle
@@ -92,28 +96,43 @@ func (t *Triangle) Equals(t2 *Triangle) bool {
 	return t.V1.Equals(t2.V1) && t.V2.Equals(t2.V2) && t.V3.Equals(t2.V3)
 }
 
-// IntersectHit using Moller-Trumbore algorithm
-func (t *Triangle) IntersectHit(r Ray) (bool, Hit) {
+// Culling selects the side of a surface rays miss. The front of a triangle is the side its winding
+// normal, (V2-V1)x(V3-V1), points to, and the front of a plane the side of its normal.
+type Culling int
+
+const (
+	// CullBack hits only the front. It is the zero value, so meshes cull their back faces unless told not to.
+	CullBack Culling = iota
+	// CullNone hits both sides, the surface is double-sided
+	CullNone
+	// CullFront hits only the back
+	CullFront
+)
+
+// intersectTriangle intersects r with the triangle v1 v2 v3 using the Moller-Trumbore algorithm,
+// returning the distance along r and the weights of v2 and v3 at the hit. Sides of the triangle
+// culling selects are missed.
+func intersectTriangle(r Ray, v1, v2, v3 Vec3, culling Culling) (float64, float64, float64, bool) {
 
 	//Find vectors for two edges sharing V1
-	e1 := t.V2.Sub(t.V1)
-	e2 := t.V3.Sub(t.V1)
+	e1 := v2.Sub(v1)
+	e2 := v3.Sub(v1)
 	//Begin calculating determinant - also used to calculate u parameter
 	p := crossProduct(r.Direction, e2)
 	//if determinant is near zero, ray lies in plane of triangle or ray is parallel to plane of triangle
 	det := dotProduct(e1, p)
-	// CULLING
-	if /*det > -EPSILON &&*/ det < EPSILON {
-		return false, NoHit
+	// det is positive for rays hitting the front
+	if math.Abs(det) < EPSILON || (det < 0 && culling == CullBack) || (det > 0 && culling == CullFront) {
+		return 0, 0, 0, false
 	}
 	invDet := 1.0 / det
 	//calculate distance from V1 to ray origin
-	s := r.Origin.Sub(t.V1)
+	s := r.Origin.Sub(v1)
 	//Calculate u parameter and test bound
 	u := dotProduct(s, p) * invDet
 	//The intersection lies outside of the triangle
 	if u < 0.0 || u > 1.0 {
-		return false, NoHit
+		return 0, 0, 0, false
 	}
 	//Prepare to test v parameter
 	q := crossProduct(s, e1)
@@ -121,18 +140,30 @@ func (t *Triangle) IntersectHit(r Ray) (bool, Hit) {
 	v := dotProduct(r.Direction, q) * invDet
 	//The intersection lies outside of the triangle
 	if v < 0.0 || u+v > 1.0 {
-		return false, NoHit
+		return 0, 0, 0, false
 	}
 	x := dotProduct(e2, q) * invDet
 	if x > EPSILON { //ray intersection
-		hitPoint := r.Origin.Add(r.Direction.Mul(x))
-		//		normal := crossProduct(e1, e2)
-		return true, Hit{x, hitPoint, t.normalAt(hitPoint)}
+		return x, u, v, true
 	}
-	return false, NoHit
+	return 0, 0, 0, false
 
 }
 
+// partials returns how the surface moves with the texture coordinates u and v, and false if the
+// texture coordinates are degenerate
+func (t *Triangle) partials() (dpdu, dpdv Vec3, ok bool) {
+	duv13, duv23 := t.T1.Sub(t.T3), t.T2.Sub(t.T3)
+	dp13, dp23 := t.V1.Sub(t.V3), t.V2.Sub(t.V3)
+	det := duv13.X*duv23.Y - duv13.Y*duv23.X
+	if math.Abs(det) < 1e-12 {
+		return zeroVec, zeroVec, false
+	}
+	dpdu = dp13.Mul(duv23.Y).Sub(dp23.Mul(duv13.Y)).Mul(1 / det)
+	dpdv = dp23.Mul(duv13.X).Sub(dp13.Mul(duv23.X)).Mul(1 / det)
+	return dpdu, dpdv, true
+}
+
 func (t *Triangle) barycentric(p Vec3) (u, v, w float64) {
 	v0 := t.V2.Sub(t.V1)
 	v1 := t.V3.Sub(t.V1)
@@ -19,7 +19,7 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"path/filepath"
 	"strconv"
 )
 
@@ -46,14 +46,29 @@ func clamp(x, min, max float64) float64 {
 	return x
 }
 
-func parseFloats(items []string) []float64 {
+// parseFloats parses every item, stopping at the first that isn't a number
+func parseFloats(items []string) ([]float64, error) {
 	result := make([]float64, len(items))
 	for i, item := range items {
 		f, err := strconv.ParseFloat(item, 64)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			return nil, fmt.Errorf("%q isn't a number", item)
 		}
 		result[i] = f
 	}
-	return result
+	return result, nil
+}
+
+// localFile returns the path of name, a file named inside another file, relative to dir, the directory of
+// that file. If confined, name must lie inside dir, as glTF URIs must, so an uploaded file can't read others
+// on the server.
+func localFile(dir, name string, confined bool) (string, error) {
+	name = filepath.FromSlash(name)
+	if confined && !filepath.IsLocal(name) {
+		return "", fmt.Errorf("%q isn't a file inside %s", name, dir)
+	}
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	return filepath.Join(dir, name), nil
 }
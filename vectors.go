@@ -18,6 +18,8 @@ package main
 */
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 )
 
@@ -125,6 +127,24 @@ func (v Vec3) Max(b Vec3) Vec3 {
 	return Vec3{math.Max(v.X, b.X), math.Max(v.Y, b.Y), math.Max(v.Z, b.Z)}
 }
 
+// MarshalJSON encodes a vector as an [x, y, z] array
+func (v Vec3) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]float64{v.X, v.Y, v.Z})
+}
+
+// UnmarshalJSON decodes a vector from an [x, y, z] array
+func (v *Vec3) UnmarshalJSON(data []byte) error {
+	var xyz []float64
+	if err := json.Unmarshal(data, &xyz); err != nil {
+		return err
+	}
+	if len(xyz) != 3 {
+		return fmt.Errorf("vector has %d components, expected 3", len(xyz))
+	}
+	v.X, v.Y, v.Z = xyz[0], xyz[1], xyz[2]
+	return nil
+}
+
 func dotProduct(a, b Vec3) float64 {
 	return a.X*b.X + a.Y*b.Y + a.Z*b.Z
 }
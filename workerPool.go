@@ -0,0 +1,53 @@
+package main
+
+/*
+   Copyright (C) 2016 Nathan Jaremko
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+import (
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// WorkerPool renders tiles for any number of renderers on a fixed number of goroutines,
+// so concurrent renders share the machine instead of each starting their own workers
+type WorkerPool struct {
+	jobChan chan poolJob
+}
+
+type poolJob struct {
+	renderer *Renderer
+	j        job
+	bar      *pb.ProgressBar
+}
+
+func newWorkerPool(workers int) *WorkerPool {
+	pool := &WorkerPool{make(chan poolJob, 10)}
+	for i := 0; i < workers; i++ {
+		go pool.worker()
+	}
+	return pool
+}
+
+func (pool *WorkerPool) worker() {
+	for pj := range pool.jobChan {
+		pj.renderer.runJob(&pj.j, pj.bar)
+	}
+}
+
+// Close stops the pool's workers once the queued tiles are done
+func (pool *WorkerPool) Close() {
+	close(pool.jobChan)
+}